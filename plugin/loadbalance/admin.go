@@ -0,0 +1,178 @@
+package loadbalance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// admin serves the admin endpoint of a session pool, to drain and resume
+// hosts without changing the configuration, and to read the audit.
+type admin struct {
+	addr    string
+	session *SessionLoadBalancer
+	mux     http.Handler
+}
+
+// adminListeners are the listeners of the admin endpoints, by address. A
+// reload starts the new admin endpoint before stopping the old one, so the
+// listener is handed over instead of listening twice on the address.
+var (
+	adminListeners      = map[string]*adminListener{}
+	adminListenersMutex sync.Mutex
+)
+
+// adminListener serves the admin endpoint last started on an address.
+type adminListener struct {
+	ln     net.Listener
+	server *http.Server
+	owner  atomic.Pointer[admin]
+}
+
+func (l *adminListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.owner.Load().mux.ServeHTTP(w, r)
+}
+
+func newAdmin(addr string, session *SessionLoadBalancer) *admin {
+	return &admin{addr: addr, session: session}
+}
+
+// handler returns the handler of the admin endpoint.
+func (a *admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/drain", a.hostAction(a.session.manager.Drain))
+	mux.HandleFunc("/resume", a.hostAction(a.session.manager.Resume))
+	mux.HandleFunc("/audit", a.audit)
+	if a.session.debugEndpoint {
+		mux.HandleFunc("/loadbalance/state", a.state)
+	}
+	return mux
+}
+
+// hostState is the state of a host, as served by the debug endpoint.
+type hostState struct {
+	IP       string    `json:"ip"`
+	Port     uint16    `json:"port"`
+	Base     float32   `json:"base"`
+	Estimate float32   `json:"estimate"`
+	Updated  time.Time `json:"updated"`
+	Active   bool      `json:"active"`
+}
+
+// state writes the state of the hosts as JSON, ordered by address.
+func (a *admin) state(w http.ResponseWriter, r *http.Request) {
+	sm := a.session.manager
+	sm.mutex.RLock()
+	addrs := make([]netip.Addr, 0, len(sm.hosts))
+	for addr := range sm.hosts {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	hosts := make([]hostState, 0, len(addrs))
+	for _, addr := range addrs {
+		host := sm.hosts[addr]
+		_, active := sm.active[addr]
+		hosts = append(hosts, hostState{
+			IP:       host.ip.String(),
+			Port:     host.port,
+			Base:     host.base,
+			Estimate: host.estimate,
+			Updated:  host.updated,
+			Active:   active,
+		})
+	}
+	sm.mutex.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hosts); err != nil {
+		log.Errorf("Failed to encode state: %v", err)
+	}
+}
+
+// audit writes the recorded first hosts of the name query parameter as JSON.
+func (a *admin) audit(w http.ResponseWriter, r *http.Request) {
+	if a.session.audit == nil {
+		http.Error(w, "Auditing not enabled", http.StatusNotFound)
+		return
+	}
+	name := dns.Fqdn(strings.ToLower(r.URL.Query().Get("name")))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.session.audit.heads(name)); err != nil {
+		log.Errorf("Failed to encode audit: %v", err)
+	}
+}
+
+// hostAction returns a handler applying action to the host in the host
+// query parameter.
+func (a *admin) hostAction(action func(netip.Addr) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		addr, err := netip.ParseAddr(r.URL.Query().Get("host"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid host: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := action(addr); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// Start listens on the admin address and serves in the background. If the
+// address is already served, e.g. by the admin endpoint of the previous
+// configuration on reload, its listener serves a from now on.
+func (a *admin) Start() error {
+	adminListenersMutex.Lock()
+	defer adminListenersMutex.Unlock()
+	a.mux = a.handler()
+	if l, ok := adminListeners[a.addr]; ok {
+		l.owner.Store(a)
+		log.Infof("Admin endpoint on %s taken over", l.ln.Addr())
+		return nil
+	}
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	l := &adminListener{ln: ln}
+	l.owner.Store(a)
+	l.server = &http.Server{Handler: l, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := l.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Admin endpoint failed: %v", err)
+		}
+	}()
+	adminListeners[a.addr] = l
+	log.Infof("Admin endpoint listening on %s", ln.Addr())
+	return nil
+}
+
+// Stop shuts the admin endpoint down, unless another admin endpoint took
+// its listener over.
+func (a *admin) Stop() error {
+	adminListenersMutex.Lock()
+	l, ok := adminListeners[a.addr]
+	if !ok || l.owner.Load() != a {
+		adminListenersMutex.Unlock()
+		return nil
+	}
+	delete(adminListeners, a.addr)
+	adminListenersMutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.server.Shutdown(ctx)
+}
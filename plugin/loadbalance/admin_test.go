@@ -0,0 +1,158 @@
+package loadbalance
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAdminDrain(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	ip, port := newTestTarget(t, "127.0.0.1", testMetrics(4, 1))
+	drained := addTestHost(sm, ip, port)
+	sm.Scrape(drained)
+	sm.updateActive(drained)
+	addActiveHost(sm, "127.0.0.2", 10)
+	session := NewSessionLoadBalancer()
+	session.manager = sm
+	handler := newAdmin("localhost:0", session).handler()
+
+	post := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec.Code
+	}
+	if code := post("/drain?host=127.0.0.1"); code != http.StatusOK {
+		t.Fatalf("Expected drain to succeed, got status %d", code)
+	}
+	if ips := sm.GetIPs(); len(ips) != 1 || ips[0].String() != "127.0.0.2" {
+		t.Errorf("Expected the drained host left out, got %v", ips)
+	}
+	// Drained hosts are still scraped.
+	_, drained.port = newTestTarget(t, "127.0.0.1", testMetrics(1, 1))
+	sm.Scrape(drained)
+	if drained.estimate != 1 {
+		t.Errorf("Expected the drained host scraped, got estimate %v", drained.estimate)
+	}
+
+	if code := post("/resume?host=127.0.0.1"); code != http.StatusOK {
+		t.Fatalf("Expected resume to succeed, got status %d", code)
+	}
+	if ips := sm.GetIPs(); len(ips) != 2 || ips[0].String() != "127.0.0.1" {
+		t.Errorf("Expected the resumed host first, got %v", ips)
+	}
+
+	if code := post("/drain?host=10.9.9.9"); code != http.StatusNotFound {
+		t.Errorf("Expected unknown host to fail, got status %d", code)
+	}
+	if code := post("/drain?host=bogus"); code != http.StatusBadRequest {
+		t.Errorf("Expected invalid host to fail, got status %d", code)
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	session := newTestSession()
+	session.audit = newAudit(3)
+	addActiveHost(session.manager, "10.0.0.1", 0)
+	addActiveHost(session.manager, "10.0.0.2", 0.5)
+	addActiveHost(session.manager, "10.0.0.3", 2)
+
+	heads := []string{}
+	for i := 0; i < 5; i++ {
+		m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+		heads = append(heads, m.Answer[0].(*dns.A).A.String())
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/audit?name=lb.example.org", nil)
+	newAdmin("localhost:0", session).handler().ServeHTTP(rec, req)
+	var audited []auditEntry
+	if err := json.NewDecoder(rec.Body).Decode(&audited); err != nil {
+		t.Fatalf("Failed to decode audit: %v", err)
+	}
+	if len(audited) != 3 {
+		t.Fatalf("Expected the last 3 heads, got %v", audited)
+	}
+	for i, entry := range audited {
+		if entry.Host != heads[2+i] {
+			t.Errorf("Expected heads %v, got %v", heads[2:], audited)
+			break
+		}
+	}
+}
+
+func TestAdminState(t *testing.T) {
+	session := newTestSession()
+	addActiveHost(session.manager, "10.0.0.2", 2)
+	addActiveHost(session.manager, "10.0.0.1", 1)
+	session.manager.Add(netip.MustParseAddr("10.0.0.3"))
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		newAdmin("localhost:0", session).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/loadbalance/state", nil))
+		return rec
+	}
+	if rec := get(); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no state without %s, got status %d", sessionDebugEndpoint, rec.Code)
+	}
+
+	session.debugEndpoint = true
+	var hosts []hostState
+	if err := json.NewDecoder(get().Body).Decode(&hosts); err != nil {
+		t.Fatalf("Failed to decode state: %v", err)
+	}
+	expected := []hostState{
+		{IP: "10.0.0.1", Base: 1, Estimate: 1, Active: true},
+		{IP: "10.0.0.2", Base: 2, Estimate: 2, Active: true},
+		{IP: "10.0.0.3"},
+	}
+	if len(hosts) != len(expected) {
+		t.Fatalf("Expected %d hosts, got %v", len(expected), hosts)
+	}
+	for i, host := range hosts {
+		want := expected[i]
+		if host.IP != want.IP || host.Base != want.Base || host.Estimate != want.Estimate || host.Active != want.Active {
+			t.Errorf("Expected %+v, got %+v", want, host)
+		}
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	const addr = "127.0.0.1:0"
+	old := newAdmin(addr, newTestSession())
+	if err := old.Start(); err != nil {
+		t.Fatalf("Failed to start the admin endpoint: %v", err)
+	}
+	url := "http://" + adminListeners[addr].ln.Addr().String() + "/loadbalance/state"
+
+	// On reload, the new admin endpoint starts before the old one stops.
+	session := newTestSession()
+	session.debugEndpoint = true
+	reloaded := newAdmin(addr, session)
+	if err := reloaded.Start(); err != nil {
+		t.Fatalf("Failed to start the reloaded admin endpoint: %v", err)
+	}
+	if err := old.Stop(); err != nil {
+		t.Fatalf("Failed to stop the old admin endpoint: %v", err)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Expected the reloaded admin endpoint served, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the state of the reloaded configuration, got status %d", resp.StatusCode)
+	}
+
+	if err := reloaded.Stop(); err != nil {
+		t.Fatalf("Failed to stop the admin endpoint: %v", err)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("Expected the admin endpoint closed after the last stop")
+	}
+}
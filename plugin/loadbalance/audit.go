@@ -0,0 +1,68 @@
+package loadbalance
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Maximum number of query names audited.
+const auditMaxNames = 1024
+
+// auditEntry is the first host of an answer.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+}
+
+// audit records the first host of the last answers, per query name, to
+// check whether balancing is fair over time.
+type audit struct {
+	size  int
+	mutex sync.Mutex
+	names map[string]*auditRing
+}
+
+// auditRing holds the last entries of a query name, overwriting the oldest.
+type auditRing struct {
+	entries []auditEntry
+	next    int
+}
+
+func newAudit(size int) *audit {
+	return &audit{size: size, names: make(map[string]*auditRing)}
+}
+
+// record adds head as the first host answered for qname.
+func (a *audit) record(qname string, head net.IP) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	ring, ok := a.names[qname]
+	if !ok {
+		if len(a.names) >= auditMaxNames {
+			return
+		}
+		ring = &auditRing{entries: make([]auditEntry, 0, a.size)}
+		a.names[qname] = ring
+	}
+	entry := auditEntry{Time: time.Now(), Host: head.String()}
+	if len(ring.entries) < a.size {
+		ring.entries = append(ring.entries, entry)
+		return
+	}
+	ring.entries[ring.next] = entry
+	ring.next = (ring.next + 1) % a.size
+}
+
+// heads returns the recorded entries of qname, oldest first.
+func (a *audit) heads(qname string) []auditEntry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	ring, ok := a.names[qname]
+	if !ok {
+		return []auditEntry{}
+	}
+	heads := make([]auditEntry, 0, len(ring.entries))
+	heads = append(heads, ring.entries[ring.next:]...)
+	return append(heads, ring.entries[:ring.next]...)
+}
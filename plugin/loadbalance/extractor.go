@@ -0,0 +1,53 @@
+package loadbalance
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// Extractor extracts the value of metric from a scraped metrics body.
+type Extractor interface {
+	Extract(body io.Reader, metric string) (float64, error)
+}
+
+// PrometheusExtractor extracts a gauge or counter from metrics in the
+// Prometheus text format. This is the default extractor.
+type PrometheusExtractor struct{}
+
+// Extract implements the Extractor interface.
+func (PrometheusExtractor) Extract(body io.Reader, metric string) (float64, error) {
+	var parser expfmt.TextParser
+	metrics, err := parser.TextToMetricFamilies(body)
+	if err != nil {
+		return 0, err
+	}
+	mf, ok := metrics[metric]
+	if !ok {
+		return 0, fmt.Errorf("metric %s not found", metric)
+	}
+	return getMetricValue(mf)
+}
+
+// JSONExtractor extracts a number from a JSON document. The metric is the
+// dot separated path of the field.
+type JSONExtractor struct{}
+
+// Extract implements the Extractor interface.
+func (JSONExtractor) Extract(body io.Reader, metric string) (float64, error) {
+	return getJSONValue(body, metric)
+}
+
+// extractors are the extractors by scrape format.
+var extractors = map[string]Extractor{
+	scrapeFormatPrometheus: PrometheusExtractor{},
+	scrapeFormatJSON:       JSONExtractor{},
+}
+
+// RegisterExtractor registers a custom extractor, selected with
+// session_scrape_format. It must be called before the server is set up,
+// e.g. from an init function.
+func RegisterExtractor(format string, extractor Extractor) {
+	extractors[format] = extractor
+}
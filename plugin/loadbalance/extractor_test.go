@@ -0,0 +1,42 @@
+package loadbalance
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// plaintextExtractor reads a metrics body holding a single number.
+type plaintextExtractor struct {
+	metrics []string
+}
+
+func (e *plaintextExtractor) Extract(body io.Reader, metric string) (float64, error) {
+	e.metrics = append(e.metrics, metric)
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+}
+
+func TestScrapeCustomExtractor(t *testing.T) {
+	extractor := &plaintextExtractor{}
+	RegisterExtractor("plaintext", extractor)
+	defer delete(extractors, "plaintext")
+
+	sm := NewSessionManager()
+	sm.scrapeFormat = "plaintext"
+	sm.scrapeMetric = "sessions"
+	ip, port := newTestTarget(t, "127.0.0.1", "12\n")
+	host := addTestHost(sm, ip, port)
+	sm.Scrape(host)
+
+	if len(extractor.metrics) != 1 || extractor.metrics[0] != "sessions" {
+		t.Errorf("Expected the custom extractor called for sessions, got %v", extractor.metrics)
+	}
+	if host.estimate != 12 || !host.healthy {
+		t.Errorf("Expected healthy host with estimate 12, got %v (healthy %v)", host.estimate, host.healthy)
+	}
+}
@@ -3,11 +3,20 @@ package loadbalance
 
 import (
 	"context"
+	"net"
+	"sort"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// Span tags of session answers.
+const (
+	tagHead   = "coredns.io/loadbalance/head"
+	tagActive = "coredns.io/loadbalance/active"
 )
 
 // RoundRobin is a plugin to rewrite responses for "load balancing".
@@ -19,10 +28,16 @@ type LoadBalance struct {
 
 // ServeDNS implements the plugin.Handler interface.
 func (lb LoadBalance) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	if lb.shuffle != nil {
-		return lb.ServeShuffle(ctx, w, r)
+	if lb.session != nil {
+		return lb.ServeSession(ctx, w, r)
 	}
-	return lb.ServeSession(ctx, w, r)
+	return lb.ServeShuffle(ctx, w, r)
+}
+
+// Ready implements the ready.Readiness interface. The session policy is
+// ready once all hosts have been scraped.
+func (lb LoadBalance) Ready() bool {
+	return lb.session == nil || lb.session.manager.Ready()
 }
 
 // ServeShuffle serves a request by shuffling results.
@@ -33,41 +48,297 @@ func (lb LoadBalance) ServeShuffle(ctx context.Context, w dns.ResponseWriter, r
 
 // ServeSession generates a response based on host session metrics.
 func (lb LoadBalance) ServeSession(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	lb.session.manager.setServer(ctx)
 	state := request.Request{W: w, Req: r}
 	qname := state.Name()
-	hostname, domain := split(qname)
-	// log.Infof("BJORN ServeSession() hostname: '%s' domain: '%s'", hostname, domain)
-	hostnameMatch := hostname == lb.session.hostname
-	domainMatch := (lb.session.domain == "" || domain == lb.session.domain)
-
-	// Initially, only support type A requests.
-	if state.QType() != dns.TypeA {
-		// log.Infof("Not handling request of type: %v", state.QType())
+	hostnameMatch, domainMatch, domain := lb.session.match(qname)
+
+	if lb.session.observeOnly || !lb.session.enabled {
+		return plugin.NextOrFailure(lb.Name(), lb.Next, ctx, w, r)
+	}
+	if !hostnameMatch && lb.session.nxdomain && dns.IsSubDomain(dns.Fqdn(lb.session.domain), qname) {
+		w.WriteMsg(lb.negative(r, qname))
+		return 0, nil
+	}
+	if !lb.session.recordTypes[state.QType()] {
 		return plugin.NextOrFailure(lb.Name(), lb.Next, ctx, w, r)
 	}
+	if hostnameMatch && domainMatch && len(r.Question) > 1 && !lb.session.firstQuestion {
+		// Only the first question would be answered.
+		return dns.RcodeRefused, nil
+	}
+	if hostnameMatch && domainMatch && lb.session.upstream {
+		rw := &sessionResponseWriter{ResponseWriter: w, session: lb.session}
+		return plugin.NextOrFailure(lb.Name(), lb.Next, ctx, rw, r)
+	}
+	if hostnameMatch && domainMatch && !lb.session.manager.Ready() {
+		switch lb.session.unready {
+		case unreadyPassthrough:
+			return plugin.NextOrFailure(lb.Name(), lb.Next, ctx, w, r)
+		case unreadyServfail:
+			if lb.session.bestEffort {
+				return plugin.NextOrFailure(lb.Name(), lb.Next, ctx, w, r)
+			}
+			return dns.RcodeServerFailure, nil
+		}
+	}
+	if hostnameMatch && domainMatch && lb.session.manager.fallback == fallbackNone && lb.session.manager.activeCount() == 0 {
+		// Fail, for clients to fail over elsewhere, instead of answering
+		// with hosts that may all be down.
+		if lb.session.bestEffort {
+			return plugin.NextOrFailure(lb.Name(), lb.Next, ctx, w, r)
+		}
+		return dns.RcodeServerFailure, nil
+	}
 	if hostnameMatch && domainMatch {
-		ips := lb.session.GetIPs()
-		answers := []dns.RR{}
-		for _, ip := range ips {
-			answers = append(answers, &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   state.QName(),
-					Rrtype: dns.TypeA,
-					Class:  state.QClass(),
-					Ttl:    1},
-				A: ip,
-			})
+		a, ok := lb.synthesize(ctx, state, domain)
+		if !ok {
+			return plugin.NextOrFailure(lb.Name(), lb.Next, ctx, w, r)
 		}
-		a := dns.Msg{Question: r.Question, Answer: answers}
-		a.SetReply(r)
-		a.Authoritative = true
-		w.WriteMsg(&a)
+		w.WriteMsg(a)
 		return 0, nil
 	}
 
-	log.Infof("Hostname / domain mismatch. hostname: %v domain: %v", hostname, domain)
+	log.Infof("Hostname / domain mismatch. name: %v domain: %v", qname, domain)
 	return plugin.NextOrFailure(lb.Name(), lb.Next, ctx, w, r)
 }
 
+// negative returns the negative answer for qname, a name in the domain other
+// than the hostname. The domain and the names between it and the hostname
+// exist without records, so they are NODATA. Other names are NXDOMAIN.
+func (lb LoadBalance) negative(r *dns.Msg, qname string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	if dns.IsSubDomain(qname, lb.session.name()) {
+		m.Rcode = dns.RcodeSuccess
+	}
+	m.Authoritative = true
+	m.Ns = []dns.RR{lb.session.SOA(lb.session.domain)}
+	return m
+}
+
+// synthesize returns the answer of the session policy. Returns false if a
+// best-effort pool failed to answer, for the query to be passed through.
+func (lb LoadBalance) synthesize(ctx context.Context, state request.Request, domain string) (m *dns.Msg, ok bool) {
+	if lb.session.bestEffort {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Errorf("Failed to answer %s: %v. Passing it through.", state.Name(), rec)
+				m, ok = nil, false
+			}
+		}()
+	}
+	client := state.IP()
+	ecs := clientSubnet(state.Req)
+	if ecs != nil {
+		client = ecs.Address.String()
+	}
+	var ips []net.IP
+	if lb.session.unready == unreadyFallback && !lb.session.manager.Ready() {
+		// Not from GetIPs, so the fallback doesn't bump the estimates.
+		ips = lb.session.manager.ShuffledIPs(state.QType())
+	} else {
+		ips = lb.session.GetIPs(client, state.QType())
+	}
+	ttl := lb.session.ttl
+	if lb.session.stickyTTL > 0 {
+		// Sticky sessions: only return the least loaded host.
+		if len(ips) > 1 {
+			ips = ips[:1]
+		}
+		ttl = lb.session.stickyTTL
+	}
+	if max := int(lb.session.maxAnswers); max > 0 {
+		ips = firstHosts(ips, max)
+	}
+	if lb.session.audit != nil && len(ips) > 0 {
+		lb.session.audit.record(state.Name(), ips[0])
+	}
+	if lb.session.logDecisions && len(ips) > 0 {
+		log.Infof("Answered %s for client %s with %v first", state.Name(), state.IP(), ips[0])
+	}
+	if span := ot.SpanFromContext(ctx); span != nil && len(ips) > 0 {
+		// Show the steering in traces.
+		span.SetTag(tagHead, ips[0].String())
+		span.SetTag(tagActive, lb.session.manager.activeCount())
+	}
+	// Only the first question is answered.
+	a := dns.Msg{Question: state.Req.Question[:1], Answer: addressRecords(state, ips, ttl)}
+	if lb.session.stickyTTL == 0 && lb.session.freshTTL > 0 {
+		for i, ip := range ips {
+			a.Answer[i].Header().Ttl = lb.session.recencyTTL(ip)
+		}
+	}
+	if len(ips) == 0 {
+		// NODATA, no hosts of this address family.
+		a.Ns = []dns.RR{lb.session.SOA(domain)}
+	}
+	a.SetReply(state.Req)
+	a.Authoritative = true
+	if ecs != nil {
+		// Echo the client subnet, scoped to the subnets answered alike.
+		a.SetEdns0(state.Req.IsEdns0().UDPSize(), state.Req.IsEdns0().Do())
+		scoped := *ecs
+		scoped.SourceScope = lb.session.ecsScope(ecs)
+		opt := a.IsEdns0()
+		opt.Option = append(opt.Option, &scoped)
+	}
+	// Compress UDP answers to fit more hosts, unless configured otherwise.
+	a.Compress = state.Proto() == "udp"
+	switch lb.session.compression {
+	case compressionOn:
+		a.Compress = true
+	case compressionOff:
+		a.Compress = false
+	}
+	if state.Proto() == "udp" {
+		fit(&a, state.Size())
+	}
+	if lb.session.diagnostics && len(a.Answer) > 0 {
+		a.Answer = append(a.Answer, lb.session.diagnosticsRecord(state.QName(), a.Answer))
+		if state.Proto() == "udp" && a.Len() > state.Size() {
+			// Never drop hosts for diagnostics.
+			a.Answer = a.Answer[:len(a.Answer)-1]
+		}
+	}
+	return &a, true
+}
+
+// fit drops the last answers of m until it fits in size bytes, the UDP
+// payload size advertised by the client. The answer is not marked truncated,
+// as the answered hosts are all usable.
+func fit(m *dns.Msg, size int) {
+	if m.Len() <= size {
+		return
+	}
+	answer := m.Answer
+	n := sort.Search(len(answer)+1, func(i int) bool {
+		m.Answer = answer[:i]
+		return m.Len() > size
+	})
+	if n > 0 {
+		n--
+	}
+	m.Answer = answer[:n]
+}
+
+// clientSubnet returns the EDNS Client Subnet option of r, or nil if there is none.
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// firstHosts returns the ips of the first max distinct hosts. Repeated ips of
+// those hosts are kept.
+func firstHosts(ips []net.IP, max int) []net.IP {
+	seen := make(map[string]bool, max)
+	for i, ip := range ips {
+		if !seen[string(ip)] {
+			if len(seen) == max {
+				return ips[:i]
+			}
+			seen[string(ip)] = true
+		}
+	}
+	return ips
+}
+
+// addressRecords returns A or AAAA records for ips, answering the question in state.
+// The records are allocated in one go, as this is done for every query.
+func addressRecords(state request.Request, ips []net.IP, ttl uint32) []dns.RR {
+	hdr := dns.RR_Header{
+		Name:   state.QName(),
+		Rrtype: state.QType(),
+		Class:  state.QClass(),
+		Ttl:    ttl}
+	answers := make([]dns.RR, len(ips))
+	if state.QType() == dns.TypeA {
+		records := make([]dns.A, len(ips))
+		for i, ip := range ips {
+			records[i] = dns.A{Hdr: hdr, A: ip}
+			answers[i] = &records[i]
+		}
+		return answers
+	}
+	records := make([]dns.AAAA, len(ips))
+	for i, ip := range ips {
+		records[i] = dns.AAAA{Hdr: hdr, AAAA: ip}
+		answers[i] = &records[i]
+	}
+	return answers
+}
+
+// sessionResponseWriter is a response writer that reranks the address records
+// by the session load of the hosts.
+type sessionResponseWriter struct {
+	dns.ResponseWriter
+	session *SessionLoadBalancer
+}
+
+// WriteMsg implements the dns.ResponseWriter interface.
+func (r *sessionResponseWriter) WriteMsg(res *dns.Msg) error {
+	if res.Rcode != dns.RcodeSuccess {
+		return r.ResponseWriter.WriteMsg(res)
+	}
+	res.Answer = r.rerank(res.Answer)
+	return r.ResponseWriter.WriteMsg(res)
+}
+
+// rerank orders the address records by session load, after any other records.
+// Duplicate address records, of the same type and address, are merged into
+// the first. Records of unknown or inactive hosts follow in their original
+// order. No other record is dropped.
+func (r *sessionResponseWriter) rerank(in []dns.RR) []dns.RR {
+	type address struct {
+		rrtype uint16
+		ip     string
+	}
+	out := []dns.RR{}
+	ips := []net.IP{}
+	seen := map[address]bool{}
+	// Records by ip, in their original order. An A and an IPv4-mapped AAAA
+	// record share the ip.
+	records := map[string][]dns.RR{}
+	for _, rr := range in {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			out = append(out, rr)
+			continue
+		}
+		key := address{rr.Header().Rrtype, ip.String()}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		ips = append(ips, ip)
+		records[key.ip] = append(records[key.ip], rr)
+	}
+	for _, ip := range r.session.manager.Rerank(ips) {
+		key := ip.String()
+		out = append(out, records[key][0])
+		records[key] = records[key][1:]
+	}
+	return out
+}
+
+// Write implements the dns.ResponseWriter interface.
+func (r *sessionResponseWriter) Write(buf []byte) (int, error) {
+	log.Warning("LoadBalance called with Write: not reranking records")
+	return r.ResponseWriter.Write(buf)
+}
+
 // Name implements the Handler interface.
 func (lb LoadBalance) Name() string { return "loadbalance" }
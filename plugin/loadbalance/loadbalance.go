@@ -2,12 +2,16 @@
 package loadbalance
 
 import (
+	"net"
+	"net/netip"
+
 	"github.com/miekg/dns"
 )
 
 const (
 	ramdomShufflePolicy      = "round_robin"
 	weightedRoundRobinPolicy = "weighted"
+	defaultPolicy            = "default_policy"
 )
 
 // LoadBalanceResponseWriter is a response writer that shuffles A, AAAA and MX records.
@@ -36,6 +40,31 @@ func randomShuffle(res *dns.Msg) *dns.Msg {
 	return res
 }
 
+// preferFirst moves the address record of the preferred address in the
+// answer of res ahead of the other address records, which stay shuffled.
+func preferFirst(res *dns.Msg, preferred netip.Addr) *dns.Msg {
+	first := -1
+	for i, r := range res.Answer {
+		var ip net.IP
+		switch r := r.(type) {
+		case *dns.A:
+			ip = r.A
+		case *dns.AAAA:
+			ip = r.AAAA
+		default:
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok && addr.Unmap() == preferred.Unmap() {
+			res.Answer[first], res.Answer[i] = res.Answer[i], res.Answer[first]
+			break
+		}
+	}
+	return res
+}
+
 func roundRobin(in []dns.RR) []dns.RR {
 	cname := []dns.RR{}
 	address := []dns.RR{}
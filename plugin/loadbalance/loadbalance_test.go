@@ -2,6 +2,7 @@ package loadbalance
 
 import (
 	"context"
+	"net/netip"
 	"testing"
 
 	"github.com/coredns/coredns/plugin"
@@ -123,6 +124,41 @@ func TestLoadBalanceRandom(t *testing.T) {
 	}
 }
 
+func TestLoadBalancePreferFirst(t *testing.T) {
+	preferred := netip.MustParseAddr("10.240.0.3")
+	rm := LoadBalance{Next: handler(), shuffle: func(res *dns.Msg) *dns.Msg {
+		return preferFirst(randomShuffle(res), preferred)
+	}}
+
+	seconds := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		req := new(dns.Msg)
+		req.SetQuestion("endpoint.region2.skydns.test.", dns.TypeA)
+		req.Answer = []dns.RR{
+			test.CNAME("cname.region2.skydns.test.	300	IN	CNAME		endpoint.region2.skydns.test."),
+			test.A("endpoint.region2.skydns.test.		300	IN	A			10.240.0.1"),
+			test.A("endpoint.region2.skydns.test.		300	IN	A			10.240.0.2"),
+			test.A("endpoint.region2.skydns.test.		300	IN	A			10.240.0.3"),
+			test.A("endpoint.region2.skydns.test.		300	IN	A			10.240.0.4"),
+		}
+		if _, err := rm.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		answer := rec.Msg.Answer
+		if answer[0].Header().Rrtype != dns.TypeCNAME {
+			t.Fatalf("Expected the CNAME first, got %v", answer[0])
+		}
+		if a := answer[1].(*dns.A).A.String(); a != "10.240.0.3" {
+			t.Fatalf("Expected the preferred address first, got %s", a)
+		}
+		seconds[answer[2].(*dns.A).A.String()] = true
+	}
+	if len(seconds) < 2 {
+		t.Errorf("Expected the other addresses shuffled, got %v second every time", seconds)
+	}
+}
+
 func TestLoadBalanceXFR(t *testing.T) {
 	rm := LoadBalance{Next: handler()}
 
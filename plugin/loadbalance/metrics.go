@@ -0,0 +1,83 @@
+package loadbalance
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Variables declared for monitoring.
+var (
+	// sessionSelectedCount is the number of answers with a host as the first record.
+	sessionSelectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "loadbalance",
+		Name:      "session_selected_total",
+		Help:      "Counter of the number of answers with the host as the first record.",
+	}, []string{"host"})
+	// sessionLastScrape is the time of the last successful scrape of a host.
+	sessionLastScrape = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "loadbalance",
+		Name:      "session_host_last_scrape_timestamp_seconds",
+		Help:      "Gauge of the Unix time of the last successful scrape of the host.",
+	}, []string{"host"})
+	// sessionScrapeBytes is the size of the scraped metrics bodies.
+	sessionScrapeBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "loadbalance",
+		Name:      "session_scrape_bytes_total",
+		Help:      "Counter of the bytes read from the metrics endpoint of the host.",
+	}, []string{"host"})
+	// sessionScrapeParseErrors is the number of scrapes failing to parse,
+	// after retries.
+	sessionScrapeParseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "loadbalance",
+		Name:      "session_scrape_parse_errors_total",
+		Help:      "Counter of the scrapes of the host failing to parse, after retries.",
+	}, []string{"host"})
+	// sessionScrapeFailures is the number of scrapes not updating the load of
+	// a host.
+	sessionScrapeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "loadbalance",
+		Name:      "scrape_failures_total",
+		Help:      "Counter of the scrapes of the host failing to update its load.",
+	}, []string{"host"})
+	// sessionHostEstimate is the current estimated load of a host, including
+	// the sessions of the answers since the last scrape.
+	sessionHostEstimate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "loadbalance",
+		Name:      "host_estimate",
+		Help:      "Gauge of the current estimated load of the host, including answers since the last scrape.",
+	}, []string{"host"})
+	// sessionActiveHosts is the number of active hosts of a pool.
+	sessionActiveHosts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "loadbalance",
+		Name:      "active_hosts",
+		Help:      "Gauge of the number of active hosts of the pool.",
+	}, []string{"pool"})
+	// sessionScrapeRetries is the number of scrapes retried after failing to parse.
+	sessionScrapeRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "loadbalance",
+		Name:      "session_scrape_retries_total",
+		Help:      "Counter of the scrapes of the host retried after failing to parse.",
+	}, []string{"host"})
+)
+
+// deleteHostMetrics deletes the series of the host from the per host metrics,
+// so removed hosts don't keep exporting stale values.
+func deleteHostMetrics(host string) {
+	sessionSelectedCount.DeleteLabelValues(host)
+	sessionLastScrape.DeleteLabelValues(host)
+	sessionScrapeBytes.DeleteLabelValues(host)
+	sessionScrapeParseErrors.DeleteLabelValues(host)
+	sessionScrapeFailures.DeleteLabelValues(host)
+	sessionHostEstimate.DeleteLabelValues(host)
+	sessionScrapeRetries.DeleteLabelValues(host)
+}
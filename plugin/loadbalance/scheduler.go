@@ -0,0 +1,60 @@
+package loadbalance
+
+import (
+	"context"
+	"time"
+)
+
+// Scheduler schedules the scrapes of the hosts.
+type Scheduler interface {
+	// Schedule starts scraping hosts and returns without blocking. Scraping
+	// stops once ctx is done. Scrapes of hosts removed from the targets are
+	// skipped, and schedulers should stop scraping them. scrape scrapes a host and updates the active
+	// set. interval returns the current per-host scrape interval. stagger is
+	// the delay between the first scrapes of hosts, to stay under the scrape
+	// budget from the start.
+	Schedule(ctx context.Context, hosts []*Host, scrape func(*Host), interval func() time.Duration, stagger time.Duration)
+}
+
+// LoopScheduler scrapes every host in its own goroutine, sleeping for the
+// rest of the interval between scrapes. This is the default scheduler.
+type LoopScheduler struct{}
+
+// Schedule implements the Scheduler interface.
+func (LoopScheduler) Schedule(ctx context.Context, hosts []*Host, scrape func(*Host), interval func() time.Duration, stagger time.Duration) {
+	var delay time.Duration
+	for _, host := range hosts {
+		go func(host *Host, delay time.Duration) {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			for {
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					return
+				case <-host.removed:
+					return
+				}
+				start := time.Now()
+				scrape(host)
+				timer.Reset(interval() - time.Since(start))
+			}
+		}(host, delay)
+		delay += stagger
+	}
+}
+
+// Built-in scrape schedulers.
+const scrapeSchedulerLoop = "loop"
+
+// schedulers are the scrape schedulers by name.
+var schedulers = map[string]Scheduler{
+	scrapeSchedulerLoop: LoopScheduler{},
+}
+
+// RegisterScheduler registers a custom scrape scheduler, selected with
+// session_scrape_scheduler. It must be called before the server is set up,
+// e.g. from an init function.
+func RegisterScheduler(name string, scheduler Scheduler) {
+	schedulers[name] = scheduler
+}
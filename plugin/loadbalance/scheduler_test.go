@@ -0,0 +1,151 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// onceScheduler scrapes every host once, synchronously.
+type onceScheduler struct {
+	scheduled int
+}
+
+func (s *onceScheduler) Schedule(ctx context.Context, hosts []*Host, scrape func(*Host), interval func() time.Duration, stagger time.Duration) {
+	for _, host := range hosts {
+		s.scheduled++
+		scrape(host)
+	}
+}
+
+func TestStartCustomScheduler(t *testing.T) {
+	scheduler := &onceScheduler{}
+	RegisterScheduler("once", scheduler)
+	defer delete(schedulers, "once")
+
+	sm := NewSessionManager()
+	sm.scheduler = schedulers["once"]
+	sm.scrapeMetric = "connections"
+	ip, port := newTestTarget(t, "127.0.0.1", testMetrics(4, 1))
+	sm.scrapePort = port
+	sm.Add(ip)
+	sm.Start()
+
+	if scheduler.scheduled != 1 {
+		t.Errorf("Expected 1 host scheduled, got %d", scheduler.scheduled)
+	}
+	host := sm.hosts[ip]
+	if host.estimate != 4 || sm.active[ip] != host {
+		t.Errorf("Expected active host with estimate 4, got %v (active %v)", host.estimate, sm.active[ip] != nil)
+	}
+	if !sm.Ready() {
+		t.Errorf("Expected ready after the scheduler scraped all hosts")
+	}
+}
+
+// fastScheduler is the loop scheduler, with a short scrape interval.
+type fastScheduler struct{}
+
+func (fastScheduler) Schedule(ctx context.Context, hosts []*Host, scrape func(*Host), interval func() time.Duration, stagger time.Duration) {
+	LoopScheduler{}.Schedule(ctx, hosts, scrape, func() time.Duration { return 5 * time.Millisecond }, stagger)
+}
+
+func TestSetTargets(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scheduler = fastScheduler{}
+	sm.scrapeMetric = "connections"
+	defer sm.Stop()
+
+	var oldRequests int32
+	oldIP, oldPort := newTestTargetHandler(t, "127.0.0.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&oldRequests, 1)
+		fmt.Fprint(w, testMetrics(1, 1))
+	}))
+	newIP, newPort := newTestTarget(t, "127.0.0.2", testMetrics(2, 1))
+	addTestHost(sm, oldIP, oldPort)
+	sm.scrapePort = newPort
+	sm.Start()
+	waitActive := func(ip netip.Addr) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			sm.mutex.RLock()
+			_, active := sm.active[ip]
+			sm.mutex.RUnlock()
+			if active {
+				return
+			}
+		}
+		t.Fatalf("Expected %s to become active", ip)
+	}
+	waitActive(oldIP)
+
+	sm.SetTargets([]netip.Addr{newIP})
+	sm.mutex.RLock()
+	_, hasOld := sm.hosts[oldIP]
+	_, hasNew := sm.hosts[newIP]
+	_, oldActive := sm.active[oldIP]
+	n := len(sm.hosts)
+	sm.mutex.RUnlock()
+	if n != 1 || hasOld || !hasNew || oldActive {
+		t.Fatalf("Expected only %s in the hosts, got %d hosts (old %v, new %v, old active %v)",
+			newIP, n, hasOld, hasNew, oldActive)
+	}
+	waitActive(newIP)
+
+	// The scrapes of the removed host stopped. One may have been in flight.
+	time.Sleep(20 * time.Millisecond)
+	stopped := atomic.LoadInt32(&oldRequests)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&oldRequests); n != stopped {
+		t.Errorf("Expected no scrapes of the removed host, got %d more", n-stopped)
+	}
+	if !sm.Ready() {
+		t.Errorf("Expected ready after replacing the targets")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scheduler = fastScheduler{}
+	sm.scrapeMetric = "connections"
+	defer sm.Stop()
+
+	var goneRequests int32
+	goneIP, gonePort := newTestTargetHandler(t, "127.0.0.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goneRequests, 1)
+		fmt.Fprint(w, testMetrics(1, 1))
+	}))
+	keptIP, keptPort := newTestTarget(t, "127.0.0.2", testMetrics(2, 1))
+	addTestHost(sm, goneIP, gonePort)
+	addTestHost(sm, keptIP, keptPort)
+	sm.Start()
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&goneRequests) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be scraped", goneIP)
+		}
+	}
+
+	sm.Remove(goneIP)
+	// Removing an unknown host is a no-op.
+	sm.Remove(netip.MustParseAddr("127.0.0.3"))
+	sm.mutex.RLock()
+	_, hasGone := sm.hosts[goneIP]
+	_, goneActive := sm.active[goneIP]
+	_, hasKept := sm.hosts[keptIP]
+	sm.mutex.RUnlock()
+	if hasGone || goneActive || !hasKept {
+		t.Fatalf("Expected only %s in the hosts (gone %v, gone active %v, kept %v)", keptIP, hasGone, goneActive, hasKept)
+	}
+
+	// The scrapes of the removed host stopped. One may have been in flight.
+	time.Sleep(20 * time.Millisecond)
+	stopped := atomic.LoadInt32(&goneRequests)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&goneRequests); n != stopped {
+		t.Errorf("Expected no scrapes of the removed host, got %d more", n-stopped)
+	}
+}
@@ -2,24 +2,204 @@
 package loadbalance
 
 import (
+	"fmt"
 	"net"
+	"net/netip"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+
+	"github.com/miekg/dns"
 )
 
 const (
-	sessionPolicy        = "session"
-	sessionTargetIps     = "session_target_ips"
-	sessionDomain        = "session_domain"
-	sessionScrapeMetric  = "session_scrape_metric"
-	sessionScrapePort    = "session_scrape_port"
-	sessionScrapeTimeout = "session_scrape_timeout"
+	sessionPolicy               = "session"
+	sessionDefaults             = "session_defaults"
+	sessionTargetIps            = "session_target_ips"
+	sessionMaxTargets           = "session_max_targets"
+	sessionTargetSample         = "session_target_sample"
+	sessionDomain               = "session_domain"
+	sessionScrapeMetric         = "session_scrape_metric"
+	sessionScrapePort           = "session_scrape_port"
+	sessionScrapeTimeout        = "session_scrape_timeout"
+	sessionHealthMetric         = "session_health_metric"
+	sessionHealthThreshold      = "session_health_threshold"
+	sessionTierWidth            = "session_tier_width"
+	sessionScrapeFailureWindow  = "session_scrape_failure_window"
+	sessionScrapeHeader         = "session_scrape_header"
+	sessionSticky               = "session_sticky"
+	sessionScrapeFormat         = "session_scrape_format"
+	sessionScrapeJSONPath       = "session_scrape_json_path"
+	sessionStartupParallelism   = "session_startup_parallelism"
+	sessionStartupDeadline      = "session_startup_deadline"
+	sessionRecordTypes          = "session_record_types"
+	sessionLogDecisions         = "session_log_decisions"
+	sessionMaxRate              = "session_max_rate"
+	sessionUpstream             = "session_upstream"
+	sessionPreferLocal          = "session_prefer_local"
+	sessionSOA                  = "session_soa"
+	sessionScrapeSubnetLimit    = "session_scrape_subnet_limit"
+	sessionWebhookURL           = "session_webhook_url"
+	sessionScrapeBudget         = "session_scrape_budget"
+	sessionSubset               = "session_subset"
+	sessionActiveFloor          = "session_active_floor"
+	sessionObserveOnly          = "session_observe_only"
+	sessionSample               = "session_sample"
+	sessionScrapeMaxBytes       = "session_scrape_max_bytes"
+	sessionRecencyTTL           = "session_recency_ttl"
+	sessionResortEpsilon        = "session_resort_epsilon"
+	sessionUnready              = "session_unready"
+	sessionAdmin                = "session_admin"
+	sessionAudit                = "session_audit"
+	sessionScrapeParseRetries   = "session_scrape_parse_retries"
+	sessionEstimateFactor       = "session_estimate_factor"
+	sessionEstimateMax          = "session_estimate_max"
+	sessionScrapeIdleTimeout    = "session_scrape_idle_timeout"
+	sessionRepeat               = "session_repeat"
+	sessionFirstQuestion        = "session_first_question"
+	sessionGenerationJitter     = "session_generation_jitter"
+	sessionScrapeScheduler      = "session_scrape_scheduler"
+	sessionSelection            = "session_selection"
+	sessionScrapeConnectRetries = "session_scrape_connect_retries"
+	sessionCapacityMetric       = "session_capacity_metric"
+	sessionMaxAnswers           = "session_max_answers"
+	sessionMaintenance          = "session_maintenance"
+	sessionDiagnostics          = "session_diagnostics"
+	sessionScrapeScheme         = "session_scrape_scheme"
+	sessionScrapePath           = "session_scrape_path"
+	sessionScrapeTLSSkipVerify  = "session_scrape_tls_skip_verify"
+	sessionScrapeCA             = "session_scrape_ca"
+	sessionBestEffort           = "session_best_effort"
+	sessionNXDomain             = "session_nxdomain"
+	sessionEstimateHalfLife     = "session_estimate_halflife"
+	sessionReadyQuorum          = "session_ready_quorum"
+	sessionTTL                  = "session_ttl"
+	sessionMetricPercentile     = "session_metric_percentile"
+	sessionScrapeLabels         = "session_scrape_labels"
+	sessionScrapeRetryCount     = "session_scrape_retries"
+	sessionScrapeMetricSuffix   = "session_scrape_metric_suffix"
+	sessionHeadRotation         = "session_head_rotation"
+	sessionDistribution         = "session_distribution"
+	sessionScrapeHTTPTimeout    = "session_scrape_http_timeout"
+	sessionActiveTimeout        = "session_active_timeout"
+	sessionExploreCount         = "session_explore_count"
+	sessionTargetDNS            = "session_target_dns"
+	sessionCompression          = "session_compression"
+	sessionDebugEndpoint        = "session_debug_endpoint"
+	sessionFallback             = "session_fallback"
+	sessionEnabled              = "session_enabled"
+	sessionScrapeQuantile       = "session_scrape_quantile"
+	sessionScrapeBucket         = "session_scrape_bucket"
+	sessionFQDN                 = "session_fqdn"
 )
 
+// Answers for queries before all hosts have been scraped.
+const (
+	unreadyPassthrough = "passthrough"
+	unreadyFallback    = "fallback"
+	unreadyServfail    = "servfail"
+)
+
+// Name compression of answers.
+const (
+	compressionOn  = "on"
+	compressionOff = "off"
+)
+
+// pools are the session managers of the configured pools, by pool identity.
+var (
+	pools      = map[string]*SessionManager{}
+	poolsMutex sync.Mutex
+)
+
+// registerPool registers sm as the pool with identity key. The scrape state
+// of the hosts of a previous pool with the same identity carries over, so a
+// reload only adds and removes the changed hosts.
+func registerPool(key string, sm *SessionManager) {
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
+	if previous, ok := pools[key]; ok {
+		sm.reconcile(previous)
+	}
+	pools[key] = sm
+}
+
+// Default TTL of the SOA record, also used as negative TTL.
+const DefaultSOATTL = 30
+
+// Default maximum number of targets, the addresses of a /20 prefix. This
+// keeps large prefixes from exhausting the memory at startup.
+const DefaultMaxTargets = 4096
+
+// Default TTL of answers. Short, for clients to follow the load, but long
+// enough for resolvers to cache answers for a few seconds.
+const DefaultTTL = 5
+
+// Default maximum number of hosts answered. Eight A records fit in a 512
+// byte UDP answer, so large pools don't force clients to retry over TCP.
+const DefaultMaxAnswers = 8
+
 // SessionLoadBalancer "load balances" answers based on (tcp) session count on the target hosts.
 type SessionLoadBalancer struct {
 	hostname string
 	domain   string
-	manager  *SessionManager
+	// Identity of the pool across reloads: its zone, hostname and domain.
+	pool string
+	// Optional fully qualified name answered, in canonical form. If set,
+	// query names must be this name, instead of matching the hostname and
+	// domain.
+	fqdn    string
+	manager *SessionManager
+	// TTL of the answered records.
+	ttl uint32
+	// If set, only the least loaded host is returned, with this TTL.
+	stickyTTL uint32
+	// If set, hosts scraped within the scrape interval are answered with
+	// freshTTL, and other hosts with staleTTL.
+	freshTTL uint32
+	staleTTL uint32
+	// Record types answered. Defaults to A.
+	recordTypes map[uint16]bool
+	// Maximum number of hosts answered, zero for all. UDP answers are also
+	// limited to the payload size advertised by the client.
+	maxAnswers uint
+	// Log the client and first host of each answer.
+	logDecisions bool
+	// Rerank the answer of the next plugin, instead of synthesizing it.
+	upstream bool
+	// Add a TXT record with the estimates of the answered hosts.
+	diagnostics bool
+	// Never answer, only scrape the hosts and export their metrics.
+	observeOnly bool
+	// Disabled pools are scraped, but pass queries through like observe
+	// only pools, to stage a pool before turning it on.
+	enabled bool
+	// Pass queries through to the next plugin if answering fails, instead
+	// of failing them.
+	bestEffort bool
+	// Answer names in the domain other than the hostname with NXDOMAIN,
+	// instead of passing them through to the next plugin.
+	nxdomain bool
+	// Answer the first question of messages with multiple questions. By
+	// default they are refused.
+	firstQuestion bool
+	// Optional answer before all hosts have been scraped. By default the
+	// answer holds the hosts scraped so far.
+	unready string
+	// Optional name compression of answers, on or off. By default UDP
+	// answers are compressed to fit more hosts, and TCP answers are not.
+	compression string
+	// Optional admin endpoint.
+	admin *admin
+	// Serve the state of the hosts on the admin endpoint.
+	debugEndpoint bool
+	// Optional audit of the first hosts answered.
+	audit *audit
+	// Optional SOA record returned in negative answers. The owner name is
+	// set per answer.
+	soa *dns.SOA
 }
 
 type PrometheusConfig struct {
@@ -28,33 +208,327 @@ type PrometheusConfig struct {
 
 func NewSessionLoadBalancer() *SessionLoadBalancer {
 	return &SessionLoadBalancer{
-		hostname: "",
-		domain:   "",
-		manager:  NewSessionManager(),
+		hostname:    "",
+		domain:      "",
+		manager:     NewSessionManager(),
+		ttl:         DefaultTTL,
+		maxAnswers:  DefaultMaxAnswers,
+		enabled:     true,
+		recordTypes: map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true},
 	}
 }
 
 func (s *SessionLoadBalancer) PrintConfig() {
 	log.Infof("Hostname: %v", s.hostname)
 	log.Infof("Domain: %v", s.domain)
+	if s.fqdn != "" {
+		log.Infof("FQDN: %v", s.fqdn)
+	}
+	types := []string{}
+	for qtype := range s.recordTypes {
+		types = append(types, dns.TypeToString[qtype])
+	}
+	log.Infof("Record Types: %v", types)
+	if s.manager.targetDNS != "" {
+		log.Infof("Target DNS: %v every %v", s.manager.targetDNS, s.manager.targetDNSInterval)
+	}
+	if s.logDecisions {
+		log.Infof("Log Decisions: %v", s.logDecisions)
+	}
+	if s.diagnostics {
+		log.Infof("Diagnostics: %v", s.diagnostics)
+	}
+	if s.upstream {
+		log.Infof("Upstream: %v", s.upstream)
+	}
+	if s.observeOnly {
+		log.Infof("Observe Only: %v", s.observeOnly)
+	}
+	if !s.enabled {
+		log.Infof("Enabled: %v", s.enabled)
+	}
+	if s.firstQuestion {
+		log.Infof("First Question: %v", s.firstQuestion)
+	}
+	if s.bestEffort {
+		log.Infof("Best Effort: %v", s.bestEffort)
+	}
+	if s.nxdomain {
+		log.Infof("NXDOMAIN: %v", s.nxdomain)
+	}
+	if s.admin != nil {
+		log.Infof("Admin: %v", s.admin.addr)
+	}
+	if s.audit != nil {
+		log.Infof("Audit: last %v answers per name", s.audit.size)
+	}
+	if s.unready != "" {
+		log.Infof("Unready: %v", s.unready)
+	}
+	if s.debugEndpoint {
+		log.Infof("Debug Endpoint: %v", s.debugEndpoint)
+	}
+	if s.manager.fallback != fallbackAll {
+		log.Infof("Fallback: %v", s.manager.fallback)
+	}
+	if s.manager.scrapeQuantile > 0 {
+		log.Infof("Scrape Quantile: %v", s.manager.scrapeQuantile)
+	}
+	if s.manager.scrapeBucket > 0 {
+		log.Infof("Scrape Bucket: %v", s.manager.scrapeBucket)
+	}
+	if s.compression != "" {
+		log.Infof("Compression: %v", s.compression)
+	}
+	if s.manager.readyQuorum > 0 {
+		log.Infof("Ready Quorum: %v active hosts", s.manager.readyQuorum)
+	}
+	if s.soa != nil {
+		log.Infof("SOA: %v %v TTL %v", s.soa.Ns, s.soa.Mbox, s.soa.Minttl)
+	}
+	if s.maxAnswers > 0 {
+		log.Infof("Max Answers: %v", s.maxAnswers)
+	}
+	log.Infof("TTL: %v seconds", s.ttl)
+	if s.stickyTTL > 0 {
+		log.Infof("Sticky TTL: %v seconds", s.stickyTTL)
+	}
+	if s.freshTTL > 0 {
+		log.Infof("Recency TTL: %v seconds fresh, %v seconds stale", s.freshTTL, s.staleTTL)
+	}
 	log.Infof("Target IPs: %v", s.manager.ListIPs())
-	log.Infof("Scrape Metric: %v", s.manager.scrapeMetric)
+	log.Infof("Scrape Format: %v", s.manager.scrapeFormat)
+	if s.manager.scrapeFormat == scrapeFormatJSON {
+		log.Infof("Scrape JSON Path: %v", s.manager.scrapeJSONPath)
+	} else if len(s.manager.scrapeBlend) > 0 {
+		for _, metric := range s.manager.scrapeBlend {
+			log.Infof("Scrape Metric: %v (weight %v)", metric.name, metric.weight)
+		}
+	} else {
+		log.Infof("Scrape Metric: %v", s.manager.scrapeMetric)
+		if len(s.manager.scrapeLabels) > 0 {
+			log.Infof("Scrape Labels: %v", s.manager.scrapeLabels)
+		}
+	}
+	if s.manager.metricSuffix {
+		log.Infof("Scrape Metric Suffix: %v", s.manager.metricSuffix)
+	}
+	if s.manager.capacityMetric != "" {
+		log.Infof("Capacity Metric: %v", s.manager.capacityMetric)
+	}
 	log.Infof("Scrape Port: %v", s.manager.scrapePort)
+	log.Infof("Scrape Scheduler: %T", s.manager.scheduler)
 	log.Infof("Scrape Interval: %v seconds", s.manager.scrapeIntervalSeconds)
-	log.Infof("Scrape Timeout: %v seconds", s.manager.scrapeTimeoutSeconds)
+	if s.manager.scrapeBudget > 0 {
+		log.Infof("Scrape Budget: %v/s (interval %v)", s.manager.scrapeBudget, s.manager.scrapeInterval())
+	}
+	log.Infof("Active Timeout: %v seconds", s.manager.activeTimeoutSeconds)
+	if s.manager.healthMetric != "" {
+		log.Infof("Health Metric: %v (threshold %v)", s.manager.healthMetric, s.manager.healthThreshold)
+	}
+	if s.manager.tierWidth > 0 {
+		log.Infof("Tier Width: %v", s.manager.tierWidth)
+	}
+	log.Infof("Scrape Parse Retries: %v", s.manager.parseRetries)
+	if s.manager.retries > 0 {
+		log.Infof("Scrape Retries: %v (delay %v, doubling)", s.manager.retries, s.manager.retryDelay)
+	}
+	log.Infof("Scrape URL: %s://HOST:PORT%s", s.manager.scrapeScheme, s.manager.scrapePath)
+	if s.manager.tlsSkipVerify {
+		log.Infof("Scrape TLS: skipping verification")
+	} else if s.manager.tlsRootCAs != nil {
+		log.Infof("Scrape TLS: custom CA bundle")
+	}
+	log.Infof("Scrape Idle Timeout: %v", s.manager.idleTimeout)
+	log.Infof("Scrape HTTP Timeout: %v", s.manager.httpTimeout)
+	if s.manager.scrapeMaxBytes > 0 {
+		log.Infof("Scrape Max Bytes: %v", s.manager.scrapeMaxBytes)
+	}
+	for key := range s.manager.scrapeHeaders {
+		log.Infof("Scrape Header: %v", key)
+	}
+	if s.manager.startupDeadline > 0 {
+		log.Infof("Startup Scrape: %v parallel, deadline %v",
+			s.manager.startupParallelism, s.manager.startupDeadline)
+	}
+	if s.manager.preferLocal {
+		log.Infof("Prefer Local: %v", s.manager.localPrefixes)
+	}
+	if s.manager.subnetLimit > 0 {
+		log.Infof("Scrape Subnet Limit: %v per /%v", s.manager.subnetLimit, s.manager.subnetBits)
+	}
+	if s.manager.estimateFactor > 0 {
+		log.Infof("Estimate Factor: %v", s.manager.estimateFactor)
+	}
+	if s.manager.estimateMax > 0 {
+		log.Infof("Estimate Max: %v", s.manager.estimateMax)
+	}
+	if s.manager.estimateHalfLife > 0 {
+		log.Infof("Estimate Half-Life: %v", s.manager.estimateHalfLife)
+	}
+	if s.manager.resortEpsilon > 0 {
+		log.Infof("Resort Epsilon: %v", s.manager.resortEpsilon)
+	}
+	log.Infof("Selection: %v", s.manager.selection)
+	log.Infof("Distribution: %v", s.manager.distribution)
+	if s.manager.generationJitter {
+		log.Infof("Generation Jitter: %v", s.manager.generationJitter)
+	}
+	if s.manager.repeatMax > 0 {
+		log.Infof("Repeat: up to %v records", s.manager.repeatMax)
+	}
+	if s.manager.exploreCount > 0 {
+		log.Infof("Explore: %v random hosts", s.manager.exploreCount)
+	}
+	if s.manager.headRotation > 1 {
+		log.Infof("Head Rotation: %v hosts", s.manager.headRotation)
+	}
+	if s.manager.sampleSize > 0 {
+		log.Infof("Sample: %v hosts", s.manager.sampleSize)
+	}
+	if s.manager.activeFloor > 0 {
+		log.Infof("Active Floor: %v", s.manager.activeFloor)
+	}
+	if s.manager.subsetSize > 0 {
+		log.Infof("Subset: %v hosts per /%v", s.manager.subsetSize, s.manager.subsetBits)
+	}
+	if w := s.manager.maintenance; w != nil {
+		log.Infof("Maintenance: %v to %v", w.start, w.end)
+	}
+	if s.manager.webhook != nil {
+		log.Infof("Webhook URL: %v", s.manager.webhook.url)
+	}
+	if s.manager.maxRate > 0 {
+		log.Infof("Max Rate: %v/s", s.manager.maxRate)
+	}
+	if s.manager.percentile > 0 {
+		log.Infof("Metric Percentile: p%v of %v scrapes", s.manager.percentile, s.manager.percentileWindow)
+	}
+	if s.manager.scrapeFailureWindow > 0 {
+		log.Infof("Scrape Failure Window: %v", s.manager.scrapeFailureWindow)
+	}
 }
 
-func split(fqdn string) (hostname, domain string) {
-	names := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
-	if len(names) > 0 {
-		hostname = names[0]
+// SOA returns the SOA record for the zone of the hostname. The domain is
+// used if no session domain is configured.
+func (s *SessionLoadBalancer) SOA(domain string) *dns.SOA {
+	if s.domain != "" {
+		domain = s.domain
+	}
+	var soa *dns.SOA
+	if s.soa != nil {
+		soa = dns.Copy(s.soa).(*dns.SOA)
+	} else {
+		// Without session_soa, the name server and mailbox are in the domain.
+		soa = newSOA(dnsutil.Join("ns.dns", domain), dnsutil.Join("hostmaster", domain), DefaultSOATTL)
+	}
+	soa.Hdr.Name = dns.Fqdn(domain)
+	return soa
+}
+
+// newSOA returns an SOA record template with the given name server, mailbox
+// and TTL.
+func newSOA(ns, mbox string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      dns.Fqdn(ns),
+		Mbox:    dns.Fqdn(mbox),
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// match returns whether qname is the answered name, whether it is in the
+// session domain, and its domain. With an FQDN, qname must be the FQDN, and
+// the domain is the parent of the FQDN. Otherwise the first labels of qname
+// must be the hostname, and the rest the session domain, if any. Names are
+// compared case-insensitively, with or without a trailing dot.
+func (s *SessionLoadBalancer) match(qname string) (hostnameMatch, domainMatch bool, domain string) {
+	if s.fqdn != "" {
+		_, domain = split(s.fqdn, 1)
+		return dns.CanonicalName(qname) == s.fqdn, true, domain
+	}
+	hostname, domain := split(dns.CanonicalName(qname), dns.CountLabel(s.hostname))
+	hostnameMatch = hostname == strings.ToLower(strings.TrimSuffix(s.hostname, "."))
+	domainMatch = s.domain == "" || domain == strings.ToLower(strings.TrimSuffix(s.domain, "."))
+	return hostnameMatch, domainMatch, domain
+}
+
+// name returns the answered name.
+func (s *SessionLoadBalancer) name() string {
+	if s.fqdn != "" {
+		return s.fqdn
 	}
-	if len(names) > 1 {
-		domain = strings.Join(names[1:], ".")
+	return dns.Fqdn(s.hostname + "." + s.domain)
+}
+
+// split splits fqdn into the hostname of the given number of labels, and
+// the domain. Hostnames may have multiple labels, e.g. _http._tcp.
+func split(fqdn string, labels int) (hostname, domain string) {
+	names := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	if labels > len(names) {
+		labels = len(names)
 	}
+	hostname = strings.Join(names[:labels], ".")
+	domain = strings.Join(names[labels:], ".")
 	return
 }
 
-func (s *SessionLoadBalancer) GetIPs() []net.IP {
-	return s.manager.GetIPs()
+// diagnosticsRecord returns a TXT record owned by name, with a string "IP=ESTIMATE"
+// for each host of answer, in order.
+func (s *SessionLoadBalancer) diagnosticsRecord(name string, answer []dns.RR) *dns.TXT {
+	txt := &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET}}
+	for _, rr := range answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if estimate, ok := s.manager.estimateOf(ip); ok {
+			txt.Txt = append(txt.Txt, fmt.Sprintf("%v=%v", ip, estimate))
+		}
+	}
+	return txt
+}
+
+// recencyTTL returns the TTL of ip, depending on when its host was last scraped.
+func (s *SessionLoadBalancer) recencyTTL(ip net.IP) uint32 {
+	if s.manager.fresh(ip) {
+		return s.freshTTL
+	}
+	return s.staleTTL
+}
+
+// ecsScope returns the scope prefix length of answers to the client subnet
+// ecs. Answers only depend on the client subnet with subsets or rendezvous
+// selection.
+func (s *SessionLoadBalancer) ecsScope(ecs *dns.EDNS0_SUBNET) uint8 {
+	if !s.perClient() {
+		return 0
+	}
+	scope := uint8(s.manager.subsetBits)
+	if ecs.SourceNetmask < scope {
+		scope = ecs.SourceNetmask
+	}
+	return scope
+}
+
+// GetIPs returns the ips to answer client with, for qtype A or AAAA.
+func (s *SessionLoadBalancer) GetIPs(client string, qtype uint16) []net.IP {
+	if s.perClient() {
+		if addr, err := netip.ParseAddr(client); err == nil {
+			return s.manager.GetClientIPs(addr.Unmap(), qtype)
+		}
+	}
+	return s.manager.GetFamilyIPs(qtype)
+}
+
+// perClient returns true if answers depend on the client subnet.
+func (s *SessionLoadBalancer) perClient() bool {
+	return s.manager.subsetSize > 0 || s.manager.selection == selectionRendezvous
 }
@@ -0,0 +1,999 @@
+package loadbalance
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	golog "log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestSession returns a session load balancer for lb.example.org.
+func newTestSession() *SessionLoadBalancer {
+	session := NewSessionLoadBalancer()
+	session.hostname = "lb"
+	session.domain = "example.org"
+	return session
+}
+
+// serveTestQuery sends a query for qname and qtype to the session load balancer.
+// Queries passed to the next plugin are refused, with no message written.
+func serveTestQuery(t *testing.T, session *SessionLoadBalancer, qname string, qtype uint16) (*dns.Msg, int) {
+	t.Helper()
+	lb := LoadBalance{Next: test.NextHandler(dns.RcodeRefused, nil), session: session}
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	req := new(dns.Msg)
+	req.SetQuestion(qname, qtype)
+	rcode, err := lb.ServeDNS(context.TODO(), rec, req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return rec.Msg, rcode
+}
+
+func TestServeSessionSticky(t *testing.T) {
+	session := newTestSession()
+	session.stickyTTL = 30
+	first := addActiveHost(session.manager, "10.0.0.1", 1)
+	second := addActiveHost(session.manager, "10.0.0.2", 1.5)
+	addActiveHost(session.manager, "10.0.0.3", 5)
+
+	for i, expected := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"} {
+		m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+		if len(m.Answer) != 1 {
+			t.Fatalf("Query %d: Expected a single answer, got %v", i, m.Answer)
+		}
+		a := m.Answer[0].(*dns.A)
+		if a.A.String() != expected {
+			t.Errorf("Query %d: Expected %s, got %s", i, expected, a.A)
+		}
+		if a.Hdr.Ttl != 30 {
+			t.Errorf("Query %d: Expected TTL 30, got %d", i, a.Hdr.Ttl)
+		}
+	}
+	if first.estimate != 3 || second.estimate != 2.5 {
+		t.Errorf("Expected estimates 3 and 2.5, got %v and %v", first.estimate, second.estimate)
+	}
+}
+
+func TestServeSessionTTL(t *testing.T) {
+	session := newTestSession()
+	addActiveHost(session.manager, "10.0.0.1", 1)
+	addActiveHost(session.manager, "10.0.0.2", 2)
+
+	for _, ttl := range []uint32{DefaultTTL, 300} {
+		session.ttl = ttl
+		m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+		for _, rr := range m.Answer {
+			if rr.Header().Ttl != ttl {
+				t.Errorf("Expected TTL %d, got %d", ttl, rr.Header().Ttl)
+			}
+		}
+	}
+}
+
+func TestServeSessionRecordTypes(t *testing.T) {
+	session := newTestSession()
+	addActiveHost(session.manager, "10.0.0.1", 1)
+	addActiveHost(session.manager, "fd00::1", 2)
+
+	// A and AAAA are answered by default.
+	m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeAAAA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::1" {
+		t.Errorf("Expected AAAA record for fd00::1, got %v", m.Answer)
+	}
+	m, _ = serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("Expected A record for 10.0.0.1, got %v", m.Answer)
+	}
+
+	session.recordTypes = map[uint16]bool{dns.TypeA: true}
+	m, rcode := serveTestQuery(t, session, "lb.example.org.", dns.TypeAAAA)
+	if rcode != dns.RcodeRefused || m != nil {
+		t.Errorf("Expected AAAA query to be passed to the next plugin, got rcode %d msg %v", rcode, m)
+	}
+
+	session.recordTypes = map[uint16]bool{dns.TypeAAAA: true}
+	m, _ = serveTestQuery(t, session, "lb.example.org.", dns.TypeAAAA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::1" {
+		t.Errorf("Expected AAAA record for fd00::1, got %v", m.Answer)
+	}
+	m, rcode = serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if rcode != dns.RcodeRefused || m != nil {
+		t.Errorf("Expected A query to be passed to the next plugin, got rcode %d msg %v", rcode, m)
+	}
+}
+
+func TestServeSessionNoDataDefault(t *testing.T) {
+	session := newTestSession()
+	addActiveHost(session.manager, "10.0.0.1", 1)
+
+	// An IPv4 only pool answers AAAA queries with NODATA.
+	m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeAAAA)
+	if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("Expected NODATA, got %v", m)
+	}
+	if len(m.Ns) != 1 {
+		t.Fatalf("Expected SOA in authority section, got %v", m.Ns)
+	}
+	soa, ok := m.Ns[0].(*dns.SOA)
+	if !ok || soa.Hdr.Name != "example.org." || soa.Ns != "ns.dns.example.org." || soa.Minttl != DefaultSOATTL {
+		t.Errorf("Expected the default SOA for example.org., got %v", m.Ns[0])
+	}
+}
+
+func TestServeSessionLogDecisions(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(io.Discard)
+
+	session := newTestSession()
+	addActiveHost(session.manager, "10.0.0.1", 1)
+	serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if strings.Contains(buf.String(), "10.240.0.1") {
+		t.Errorf("Expected no decision logged by default, got %q", buf.String())
+	}
+
+	session.logDecisions = true
+	serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if !strings.Contains(buf.String(), "client 10.240.0.1 with 10.0.0.1 first") {
+		t.Errorf("Expected decision logged with the client ip, got %q", buf.String())
+	}
+}
+
+func TestServeSessionUpstream(t *testing.T) {
+	session := newTestSession()
+	session.upstream = true
+	addActiveHost(session.manager, "10.0.0.1", 5)
+	addActiveHost(session.manager, "10.0.0.3", 1)
+
+	next := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{
+			test.A("lb.example.org.	300	IN	A	10.0.0.1"),
+			test.A("lb.example.org.	300	IN	A	10.0.0.2"),
+			test.A("lb.example.org.	300	IN	A	10.0.0.3"),
+			test.A("lb.example.org.	300	IN	A	10.0.0.4"),
+		}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+	lb := LoadBalance{Next: next, session: session}
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	req := new(dns.Msg)
+	req.SetQuestion("lb.example.org.", dns.TypeA)
+	if _, err := lb.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []string{"10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.4"}
+	if len(rec.Msg.Answer) != len(expected) {
+		t.Fatalf("Expected %d answers, got %v", len(expected), rec.Msg.Answer)
+	}
+	for i, ip := range expected {
+		if a := rec.Msg.Answer[i].(*dns.A); a.A.String() != ip {
+			t.Errorf("Answer %d: Expected %s, got %s", i, ip, a.A)
+		}
+	}
+	if host := session.manager.active[netip.MustParseAddr("10.0.0.3")]; host.estimate != 2 {
+		t.Errorf("Expected estimate of first host to be incremented to 2, got %v", host.estimate)
+	}
+}
+
+func TestServeSessionUpstreamDuplicates(t *testing.T) {
+	session := newTestSession()
+	session.upstream = true
+	addActiveHost(session.manager, "10.0.0.1", 5)
+	addActiveHost(session.manager, "10.0.0.3", 1)
+
+	next := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{
+			test.CNAME("lb.example.org.	300	IN	CNAME	pool.example.org."),
+			test.A("pool.example.org.	300	IN	A	10.0.0.4"),
+			test.A("pool.example.org.	300	IN	A	10.0.0.1"),
+			test.A("pool.example.org.	300	IN	A	10.0.0.2"),
+			test.A("pool.example.org.	60	IN	A	10.0.0.1"),
+			test.A("pool.example.org.	300	IN	A	10.0.0.3"),
+			test.A("pool.example.org.	300	IN	A	10.0.0.4"),
+		}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+	lb := LoadBalance{Next: next, session: session}
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	req := new(dns.Msg)
+	req.SetQuestion("lb.example.org.", dns.TypeA)
+	if _, err := lb.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Duplicates are merged into the first record. Unknown hosts follow in
+	// their original order, and other records are kept first.
+	expected := []string{"pool.example.org.", "10.0.0.3", "10.0.0.1", "10.0.0.4", "10.0.0.2"}
+	if len(rec.Msg.Answer) != len(expected) {
+		t.Fatalf("Expected %d answers, got %v", len(expected), rec.Msg.Answer)
+	}
+	if cname, ok := rec.Msg.Answer[0].(*dns.CNAME); !ok || cname.Target != expected[0] {
+		t.Errorf("Answer 0: Expected CNAME %s, got %v", expected[0], rec.Msg.Answer[0])
+	}
+	for i, ip := range expected[1:] {
+		if a := rec.Msg.Answer[i+1].(*dns.A); a.A.String() != ip {
+			t.Errorf("Answer %d: Expected %s, got %s", i+1, ip, a.A)
+		}
+	}
+	if ttl := rec.Msg.Answer[2].Header().Ttl; ttl != 300 {
+		t.Errorf("Expected the first duplicate of 10.0.0.1 with TTL 300, got %d", ttl)
+	}
+}
+
+func BenchmarkServeSession(b *testing.B) {
+	session := newTestSession()
+	for i := 0; i < 100; i++ {
+		addActiveHost(session.manager, fmt.Sprintf("10.0.%d.%d", i/256, i%256), float32(i))
+	}
+	lb := LoadBalance{Next: test.NextHandler(dns.RcodeRefused, nil), session: session}
+	w := &test.ResponseWriter{}
+	req := new(dns.Msg)
+	req.SetQuestion("lb.example.org.", dns.TypeA)
+	ctx := context.TODO()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lb.ServeDNS(ctx, w, req)
+	}
+}
+
+func TestServeSessionNoData(t *testing.T) {
+	session := newTestSession()
+	session.recordTypes = map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true}
+	session.soa = newSOA("ns.example.org", "hostmaster.example.org", 60)
+	addActiveHost(session.manager, "10.0.0.1", 1)
+
+	m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeAAAA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("Expected NODATA, got rcode %d answer %v", m.Rcode, m.Answer)
+	}
+	if len(m.Ns) != 1 {
+		t.Fatalf("Expected SOA in authority section, got %v", m.Ns)
+	}
+	soa, ok := m.Ns[0].(*dns.SOA)
+	if !ok || soa.Hdr.Name != "example.org." || soa.Ns != "ns.example.org." || soa.Minttl != 60 {
+		t.Errorf("Expected SOA for example.org., got %v", m.Ns[0])
+	}
+
+	// No SOA when the family has hosts.
+	m, _ = serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if len(m.Answer) != 1 || len(m.Ns) != 0 {
+		t.Errorf("Expected a single A record and no SOA, got answer %v ns %v", m.Answer, m.Ns)
+	}
+}
+
+func TestServeSessionNXDomain(t *testing.T) {
+	session := newTestSession()
+	session.hostname = "_http._tcp"
+	session.nxdomain = true
+	session.soa = newSOA("ns.example.org", "hostmaster.example.org", 60)
+	addActiveHost(session.manager, "10.0.0.1", 1)
+
+	tests := []struct {
+		qname string
+		rcode int
+	}{
+		{"www.example.org.", dns.RcodeNameError},
+		{"x._http._tcp.example.org.", dns.RcodeNameError},
+		{"_tcp.example.org.", dns.RcodeSuccess},
+		{"example.org.", dns.RcodeSuccess},
+	}
+	for _, tc := range tests {
+		m, _ := serveTestQuery(t, session, tc.qname, dns.TypeA)
+		if m == nil || m.Rcode != tc.rcode || len(m.Answer) != 0 || !m.Authoritative {
+			t.Errorf("%s: Expected authoritative rcode %d without answers, got %v", tc.qname, tc.rcode, m)
+			continue
+		}
+		if len(m.Ns) != 1 {
+			t.Errorf("%s: Expected SOA in authority section, got %v", tc.qname, m.Ns)
+			continue
+		}
+		if soa, ok := m.Ns[0].(*dns.SOA); !ok || soa.Hdr.Name != "example.org." {
+			t.Errorf("%s: Expected SOA for example.org., got %v", tc.qname, m.Ns[0])
+		}
+	}
+
+	// Names outside the domain are passed through.
+	m, rcode := serveTestQuery(t, session, "www.example.com.", dns.TypeA)
+	if m != nil || rcode != dns.RcodeRefused {
+		t.Errorf("Expected query passed to the next plugin, got rcode %d msg %v", rcode, m)
+	}
+}
+
+func TestServeSessionObserveOnly(t *testing.T) {
+	session := newTestSession()
+	session.observeOnly = true
+	session.manager.scrapeMetric = "connections"
+	ip, port := newTestTarget(t, "127.0.0.6", testMetrics(7, 1))
+	host := addTestHost(session.manager, ip, port)
+	session.manager.Scrape(host)
+	session.manager.updateActive(host)
+
+	m, rcode := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if m != nil || rcode != dns.RcodeRefused {
+		t.Errorf("Expected query passed to the next plugin, got rcode %d msg %v", rcode, m)
+	}
+	if got := testutil.ToFloat64(sessionHostEstimate.WithLabelValues(ip.String())); got != 7 {
+		t.Errorf("Expected estimate metric 7, got %v", got)
+	}
+}
+
+func TestServeSessionEnabled(t *testing.T) {
+	session := newTestSession()
+	session.enabled = false
+	addActiveHost(session.manager, "10.0.0.1", 1)
+
+	m, rcode := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if m != nil || rcode != dns.RcodeRefused {
+		t.Errorf("Expected query passed to the next plugin while disabled, got rcode %d msg %v", rcode, m)
+	}
+	session.enabled = true
+	m, rcode = serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("Expected an answer with 10.0.0.1 once enabled, got rcode %d msg %v", rcode, m)
+	}
+}
+
+func TestServeSessionNameCase(t *testing.T) {
+	session := newTestSession()
+	session.hostname = "foo"
+	session.domain = "example.com"
+	addActiveHost(session.manager, "10.0.0.1", 1)
+	tests := []struct {
+		qname    string
+		answered bool
+	}{
+		{"foo.example.com.", true},
+		{"FOO.Example.COM.", true},
+		{"Foo.EXAMPLE.com.", true},
+		{"bar.example.com.", false},
+		{"FOO.Example.ORG.", false},
+	}
+	for _, tc := range tests {
+		m, rcode := serveTestQuery(t, session, tc.qname, dns.TypeA)
+		if answered := rcode == dns.RcodeSuccess && m != nil && len(m.Answer) == 1; answered != tc.answered {
+			t.Errorf("%s: Expected answered %v, got rcode %s msg %v", tc.qname, tc.answered, dns.RcodeToString[rcode], m)
+		}
+	}
+
+	// Names configured outside of the setup are normalized as well.
+	session.hostname = "Foo"
+	session.domain = "Example.COM."
+	for _, qname := range []string{"foo.example.com.", "FOO.Example.COM."} {
+		hostnameMatch, domainMatch, _ := session.match(qname)
+		if !hostnameMatch || !domainMatch {
+			t.Errorf("%s: Expected a match of Foo in Example.COM., got hostname %v domain %v", qname, hostnameMatch, domainMatch)
+		}
+	}
+}
+
+func TestServeSessionFQDN(t *testing.T) {
+	session := newTestSession()
+	session.hostname = "foo"
+	session.domain = ""
+	addActiveHost(session.manager, "10.0.0.1", 1)
+
+	// Without an FQDN, the first label matches in any domain.
+	if _, rcode := serveTestQuery(t, session, "foo.bar.example.com.", dns.TypeA); rcode != dns.RcodeSuccess {
+		t.Errorf("Expected foo.bar.example.com. answered by hostname, got %s", dns.RcodeToString[rcode])
+	}
+
+	session.fqdn = "foo.bar.example.com."
+	tests := []struct {
+		qname    string
+		answered bool
+	}{
+		{"foo.bar.example.com.", true},
+		{"FOO.Bar.Example.COM.", true},
+		{"foo.example.com.", false},
+		{"foo.bar.example.org.", false},
+		{"x.foo.bar.example.com.", false},
+	}
+	for _, tc := range tests {
+		m, rcode := serveTestQuery(t, session, tc.qname, dns.TypeA)
+		if answered := rcode == dns.RcodeSuccess && m != nil && len(m.Answer) == 1; answered != tc.answered {
+			t.Errorf("%s: Expected answered %v, got rcode %s msg %v", tc.qname, tc.answered, dns.RcodeToString[rcode], m)
+		}
+	}
+}
+
+func TestServeSessionClientSubnet(t *testing.T) {
+	tests := []struct {
+		subsetSize uint
+		scope      uint8
+	}{
+		{0, 0},
+		{2, 24},
+	}
+	for _, tc := range tests {
+		session := newTestSession()
+		session.manager.subsetSize = tc.subsetSize
+		for i := 1; i <= 5; i++ {
+			addActiveHost(session.manager, fmt.Sprintf("10.0.0.%d", i), 0)
+		}
+		lb := LoadBalance{Next: test.NextHandler(dns.RcodeRefused, nil), session: session}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		req := new(dns.Msg)
+		req.SetQuestion("lb.example.org.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 32,
+			Address:       net.ParseIP("192.168.5.7").To4(),
+		})
+		if _, err := lb.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		opt := rec.Msg.IsEdns0()
+		if opt == nil || len(opt.Option) != 1 {
+			t.Fatalf("Subset %d: Expected an OPT record with a single option, got %v", tc.subsetSize, opt)
+		}
+		ecs, ok := opt.Option[0].(*dns.EDNS0_SUBNET)
+		if !ok || !ecs.Address.Equal(net.ParseIP("192.168.5.7")) || ecs.SourceNetmask != 32 {
+			t.Fatalf("Subset %d: Expected the client subnet echoed, got %v", tc.subsetSize, opt.Option[0])
+		}
+		if ecs.SourceScope != tc.scope {
+			t.Errorf("Subset %d: Expected scope %d, got %d", tc.subsetSize, tc.scope, ecs.SourceScope)
+		}
+	}
+}
+
+func TestServeSessionRecencyTTL(t *testing.T) {
+	session := newTestSession()
+	session.freshTTL = 5
+	session.staleTTL = 60
+	addActiveHost(session.manager, "10.0.0.1", 1)
+	stale := addActiveHost(session.manager, "10.0.0.2", 2)
+	stale.updated = time.Now().Add(-20 * time.Second)
+
+	m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	expected := map[string]uint32{"10.0.0.1": 5, "10.0.0.2": 60}
+	if len(m.Answer) != 2 {
+		t.Fatalf("Expected 2 answers, got %v", m.Answer)
+	}
+	for _, rr := range m.Answer {
+		a := rr.(*dns.A)
+		if ttl := expected[a.A.String()]; a.Hdr.Ttl != ttl {
+			t.Errorf("Expected TTL %d for %v, got %d", ttl, a.A, a.Hdr.Ttl)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		fqdn     string
+		labels   int
+		hostname string
+		domain   string
+	}{
+		{"lb.example.org.", 1, "lb", "example.org"},
+		{"lb.", 1, "lb", ""},
+		{"_http._tcp.example.org.", 2, "_http._tcp", "example.org"},
+		{"_http._tcp.", 2, "_http._tcp", ""},
+		{"_http.", 2, "_http", ""},
+	}
+	for i, test := range tests {
+		hostname, domain := split(test.fqdn, test.labels)
+		if hostname != test.hostname || domain != test.domain {
+			t.Errorf("Test %d: Expected %q and %q, got %q and %q",
+				i, test.hostname, test.domain, hostname, domain)
+		}
+	}
+}
+
+func TestServeSessionUnderscores(t *testing.T) {
+	session := newTestSession()
+	session.hostname = "_http._tcp"
+	addActiveHost(session.manager, "10.0.0.1", 0)
+
+	tests := []struct {
+		qname string
+		match bool
+	}{
+		{"_http._tcp.example.org.", true},
+		{"_HTTP._tcp.example.org.", true},
+		{"_http.example.org.", false},
+		{"_tcp.example.org.", false},
+		{"x._http._tcp.example.org.", false},
+		{"_http._tcp.example.com.", false},
+	}
+	for _, test := range tests {
+		m, rcode := serveTestQuery(t, session, test.qname, dns.TypeA)
+		if match := m != nil && len(m.Answer) == 1; match != test.match {
+			t.Errorf("%s: Expected match %v, got rcode %d msg %v", test.qname, test.match, rcode, m)
+		}
+	}
+}
+
+func TestServeSessionUnready(t *testing.T) {
+	tests := []struct {
+		unready string
+		rcode   int
+		answers int
+	}{
+		{"", dns.RcodeSuccess, 1},
+		{unreadyPassthrough, dns.RcodeRefused, 0},
+		{unreadyFallback, dns.RcodeSuccess, 2},
+		{unreadyServfail, dns.RcodeServerFailure, 0},
+	}
+	for _, tc := range tests {
+		session := newTestSession()
+		session.unready = tc.unready
+		first := addActiveHost(session.manager, "10.0.0.1", 0)
+		addTestHost(session.manager, netip.MustParseAddr("10.0.0.2"), 0)
+		session.manager.unscraped = 1
+
+		m, rcode := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+		answers := 0
+		if m != nil {
+			rcode = m.Rcode
+			answers = len(m.Answer)
+		}
+		if rcode != tc.rcode || answers != tc.answers {
+			t.Errorf("Unready %q: Expected rcode %d with %d answers, got rcode %d with %d answers",
+				tc.unready, tc.rcode, tc.answers, rcode, answers)
+		}
+		if tc.unready == unreadyFallback && first.estimate != 0 {
+			t.Errorf("Unready %q: Expected the estimate unchanged, got %v", tc.unready, first.estimate)
+		}
+
+		// Once ready, all modes answer from the scraped hosts.
+		session.manager.unscraped = 0
+		m, _ = serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+		if m == nil || len(m.Answer) != 1 {
+			t.Errorf("Unready %q: Expected a single answer once ready, got %v", tc.unready, m)
+		}
+	}
+}
+
+func TestServeSessionUnreadyFallbackScrapes(t *testing.T) {
+	session := newTestSession()
+	session.unready = unreadyFallback
+	sm := session.manager
+	sm.scrapeMetric = "connections"
+	hosts := []*Host{}
+	for _, addr := range []string{"127.0.0.1", "127.0.0.2"} {
+		ip, port := newTestTarget(t, addr, testMetrics(1, 1))
+		hosts = append(hosts, addTestHost(sm, ip, port))
+	}
+	// Removing the unscheduled third host counts down, so stay well above.
+	sm.unscraped = 1 << 20
+
+	// Run with -race: the fallback reads the hosts while scrapes and target
+	// updates change them.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		targets := []netip.Addr{hosts[0].ip, hosts[1].ip, netip.MustParseAddr("127.0.0.3")}
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				sm.SetTargets(targets[:2+i%2])
+			}
+		}
+	}()
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host *Host) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					sm.Scrape(host)
+				}
+			}
+		}(host)
+	}
+	for i := 0; i < 2000; i++ {
+		if m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA); m == nil || len(m.Answer) < 2 {
+			t.Errorf("Expected all hosts in the fallback answer, got %v", m)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestServeSessionFallbackFamily(t *testing.T) {
+	session := newTestSession()
+	session.recordTypes = map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "2001:db8::1", "2001:db8::2"} {
+		addTestHost(session.manager, netip.MustParseAddr(ip), 0)
+	}
+
+	// No active hosts, so all known hosts of the queried family are returned.
+	for i := 0; i < 10; i++ {
+		m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+		if len(m.Answer) != 2 {
+			t.Fatalf("Expected 2 A records, got %v", m.Answer)
+		}
+		for _, rr := range m.Answer {
+			if a, ok := rr.(*dns.A); !ok || a.A.To4() == nil {
+				t.Errorf("Expected only IPv4 addresses for A, got %v", rr)
+			}
+		}
+		m, _ = serveTestQuery(t, session, "lb.example.org.", dns.TypeAAAA)
+		if len(m.Answer) != 2 {
+			t.Fatalf("Expected 2 AAAA records, got %v", m.Answer)
+		}
+		for _, rr := range m.Answer {
+			if aaaa, ok := rr.(*dns.AAAA); !ok || aaaa.AAAA.To4() != nil {
+				t.Errorf("Expected only IPv6 addresses for AAAA, got %v", rr)
+			}
+		}
+	}
+}
+
+func TestServeSessionRepeat(t *testing.T) {
+	session := newTestSession()
+	session.manager.repeatMax = 8
+	addActiveHost(session.manager, "10.0.0.1", 1)
+	addActiveHost(session.manager, "10.0.0.2", 4)
+	addActiveHost(session.manager, "10.0.0.3", 9)
+
+	m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if len(m.Answer) > 8 {
+		t.Fatalf("Expected at most 8 answers, got %d", len(m.Answer))
+	}
+	counts := map[string]int{}
+	for _, rr := range m.Answer {
+		counts[rr.(*dns.A).A.String()]++
+	}
+	expected := map[string]int{"10.0.0.1": 5, "10.0.0.2": 2, "10.0.0.3": 1}
+	for ip, n := range expected {
+		if counts[ip] != n {
+			t.Errorf("Expected %s %d times, got %d", ip, n, counts[ip])
+		}
+	}
+}
+
+func TestServeSessionRepeatMaxAnswers(t *testing.T) {
+	session := newTestSession()
+	session.maxAnswers = 2
+	session.manager.repeatMax = 8
+	session.manager.repeatHosts = 2
+	addActiveHost(session.manager, "10.0.0.1", 1)
+	addActiveHost(session.manager, "10.0.0.2", 4)
+	addActiveHost(session.manager, "10.0.0.3", 9)
+
+	// The two least loaded hosts are repeated in proportion.
+	m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	counts := map[string]int{}
+	for _, rr := range m.Answer {
+		counts[rr.(*dns.A).A.String()]++
+	}
+	expected := map[string]int{"10.0.0.1": 5, "10.0.0.2": 2, "10.0.0.3": 0}
+	for ip, n := range expected {
+		if counts[ip] != n {
+			t.Errorf("Expected %s %d times, got %d", ip, n, counts[ip])
+		}
+	}
+}
+
+func TestServeSessionMultipleQuestions(t *testing.T) {
+	for _, firstQuestion := range []bool{false, true} {
+		session := newTestSession()
+		session.firstQuestion = firstQuestion
+		addActiveHost(session.manager, "10.0.0.1", 1)
+
+		lb := LoadBalance{Next: test.NextHandler(dns.RcodeRefused, nil), session: session}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		req := new(dns.Msg)
+		req.SetQuestion("lb.example.org.", dns.TypeA)
+		req.Question = append(req.Question, dns.Question{
+			Name: "other.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		rcode, err := lb.ServeDNS(context.TODO(), rec, req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !firstQuestion {
+			if rcode != dns.RcodeRefused || rec.Msg != nil {
+				t.Errorf("Expected refused without answer, got rcode %d msg %v", rcode, rec.Msg)
+			}
+			continue
+		}
+		if rcode != dns.RcodeSuccess {
+			t.Fatalf("Expected rcode %d, got %d", dns.RcodeSuccess, rcode)
+		}
+		if len(rec.Msg.Question) != 1 || rec.Msg.Question[0].Name != "lb.example.org." {
+			t.Errorf("Expected only the first question, got %v", rec.Msg.Question)
+		}
+		if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].Header().Name != "lb.example.org." {
+			t.Errorf("Expected an answer to the first question, got %v", rec.Msg.Answer)
+		}
+	}
+}
+
+func TestServeSessionMultipleQuestionsRefused(t *testing.T) {
+	session := newTestSession()
+	addActiveHost(session.manager, "10.0.0.1", 1)
+
+	// Refused by the session policy itself, not passed through.
+	next := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		t.Errorf("Expected the query not passed to the next plugin")
+		return dns.RcodeServerFailure, nil
+	})
+	lb := LoadBalance{Next: next, session: session}
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	req := new(dns.Msg)
+	req.SetQuestion("lb.example.org.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{
+		Name: "other.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	rcode, err := lb.ServeDNS(context.TODO(), rec, req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if rcode != dns.RcodeRefused || rec.Msg != nil {
+		t.Errorf("Expected refused without answer, got rcode %d msg %v", rcode, rec.Msg)
+	}
+}
+
+func TestServeSessionMixedFamilies(t *testing.T) {
+	session := newTestSession()
+	session.recordTypes = map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true}
+	v4 := addActiveHost(session.manager, "10.0.0.1", 1)
+	v6 := addActiveHost(session.manager, "fd00::1", 5)
+	addActiveHost(session.manager, "fd00::2", 7)
+
+	m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeAAAA)
+	if len(m.Answer) != 2 || m.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::1" {
+		t.Fatalf("Expected AAAA records with fd00::1 first, got %v", m.Answer)
+	}
+	// Only the first host of the queried family is counted.
+	if v6.estimate != 6 || v4.estimate != 1 {
+		t.Errorf("Expected estimates 6 (fd00::1) and 1 (10.0.0.1), got %v and %v", v6.estimate, v4.estimate)
+	}
+
+	m, _ = serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatalf("Expected a single A record for 10.0.0.1, got %v", m.Answer)
+	}
+	if v6.estimate != 6 || v4.estimate != 2 {
+		t.Errorf("Expected estimates 6 (fd00::1) and 2 (10.0.0.1), got %v and %v", v6.estimate, v4.estimate)
+	}
+}
+
+func TestServeSessionSpanTags(t *testing.T) {
+	session := newTestSession()
+	addActiveHost(session.manager, "10.0.0.1", 3)
+	addActiveHost(session.manager, "10.0.0.2", 1)
+
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("servedns")
+	ctx := ot.ContextWithSpan(context.TODO(), span)
+	lb := LoadBalance{Next: test.NextHandler(dns.RcodeRefused, nil), session: session}
+	req := new(dns.Msg)
+	req.SetQuestion("lb.example.org.", dns.TypeA)
+	if _, err := lb.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	span.Finish()
+
+	tags := tracer.FinishedSpans()[0].Tags()
+	if tags[tagHead] != "10.0.0.2" {
+		t.Errorf("Expected head 10.0.0.2, got %v", tags[tagHead])
+	}
+	if tags[tagActive] != 2 {
+		t.Errorf("Expected 2 active hosts, got %v", tags[tagActive])
+	}
+}
+
+func TestServeSessionMaxAnswers(t *testing.T) {
+	tests := []struct {
+		tcp        bool
+		bufsize    uint16
+		maxAnswers uint
+		expected   int
+	}{
+		// 512 bytes fit 30 A records.
+		{false, 0, 0, 30},
+		{false, 0, 50, 30},
+		{false, 0, 10, 10},
+		{false, 4096, 50, 50},
+		{true, 0, 50, 50},
+		{true, 0, 0, 100},
+	}
+	session := newTestSession()
+	for i := 1; i <= 100; i++ {
+		addActiveHost(session.manager, fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), float32(i))
+	}
+	for i, tc := range tests {
+		session.maxAnswers = tc.maxAnswers
+		lb := LoadBalance{Next: test.NextHandler(dns.RcodeRefused, nil), session: session}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tc.tcp})
+		req := new(dns.Msg)
+		req.SetQuestion("lb.example.org.", dns.TypeA)
+		if tc.bufsize > 0 {
+			req.SetEdns0(tc.bufsize, false)
+		}
+		if _, err := lb.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if len(rec.Msg.Answer) != tc.expected {
+			t.Errorf("Test %d: Expected %d answers, got %d", i, tc.expected, len(rec.Msg.Answer))
+		}
+		if rec.Msg.Truncated {
+			t.Errorf("Test %d: Expected answer not marked truncated", i)
+		}
+	}
+}
+
+func TestServeSessionDefaultMaxAnswers(t *testing.T) {
+	session := newTestSession()
+	for i := 1; i <= 20; i++ {
+		addActiveHost(session.manager, fmt.Sprintf("10.0.0.%d", i), float32(i))
+	}
+
+	m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if len(m.Answer) != DefaultMaxAnswers {
+		t.Fatalf("Expected %d answers, got %d", DefaultMaxAnswers, len(m.Answer))
+	}
+	for i, rr := range m.Answer {
+		if expected := fmt.Sprintf("10.0.0.%d", i+1); rr.(*dns.A).A.String() != expected {
+			t.Errorf("Answer %d: Expected %s, got %s", i, expected, rr.(*dns.A).A)
+		}
+	}
+	// Only the first host is counted for the answer.
+	if host := session.manager.hosts[netip.MustParseAddr("10.0.0.1")]; host.estimate != 2 {
+		t.Errorf("Expected estimate of the first host to be incremented to 2, got %v", host.estimate)
+	}
+}
+
+func TestServeSessionExplore(t *testing.T) {
+	session := newTestSession()
+	session.manager.exploreCount = 3
+	addActiveHost(session.manager, "10.0.0.1", 0)
+	for i := 2; i <= 10; i++ {
+		addActiveHost(session.manager, fmt.Sprintf("10.0.0.%d", i), 100)
+	}
+
+	tails := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+		if len(m.Answer) != 4 {
+			t.Fatalf("Query %d: Expected 4 answers, got %v", i, m.Answer)
+		}
+		if head := m.Answer[0].(*dns.A).A.String(); head != "10.0.0.1" {
+			t.Errorf("Query %d: Expected the least-loaded host first, got %s", i, head)
+		}
+		seen := map[string]bool{}
+		for _, rr := range m.Answer[1:] {
+			ip := rr.(*dns.A).A.String()
+			if ip == "10.0.0.1" || seen[ip] {
+				t.Errorf("Query %d: Expected 3 distinct other hosts, got %v", i, m.Answer)
+			}
+			seen[ip] = true
+		}
+		tails[fmt.Sprint(m.Answer[1:])] = true
+	}
+	if len(tails) < 2 {
+		t.Errorf("Expected the explored hosts to vary, got %v", tails)
+	}
+}
+
+func TestServeSessionDiagnostics(t *testing.T) {
+	session := newTestSession()
+	session.diagnostics = true
+	addActiveHost(session.manager, "10.0.0.1", 3)
+	addActiveHost(session.manager, "10.0.0.2", 1.5)
+
+	m, _ := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if len(m.Answer) != 3 || len(m.Extra) != 0 {
+		t.Fatalf("Expected 2 answers and a TXT record, got %v %v", m.Answer, m.Extra)
+	}
+	txt, ok := m.Answer[2].(*dns.TXT)
+	if !ok || txt.Hdr.Name != "lb.example.org." {
+		t.Fatalf("Expected TXT record for lb.example.org. after the hosts, got %v", m.Answer[2])
+	}
+	// 10.0.0.2 is counted for the answer.
+	expected := []string{"10.0.0.2=2.5", "10.0.0.1=3"}
+	if fmt.Sprint(txt.Txt) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, txt.Txt)
+	}
+}
+
+func TestServeSessionBestEffort(t *testing.T) {
+	session := newTestSession()
+	session.bestEffort = true
+	addActiveHost(session.manager, "10.0.0.1", 0)
+	// Inject a failure into the host selection.
+	session.manager.maintenance = &window{start: 0, end: time.Hour}
+	session.manager.now = func() time.Time { panic("injected") }
+
+	m, rcode := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if m != nil || rcode != dns.RcodeRefused {
+		t.Errorf("Expected query passed to the next plugin, got rcode %d msg %v", rcode, m)
+	}
+
+	// Unready pools pass through instead of failing.
+	session.manager.maintenance = nil
+	session.manager.unscraped = 1
+	session.unready = unreadyServfail
+	m, rcode = serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if m != nil || rcode != dns.RcodeRefused {
+		t.Errorf("Expected unready query passed to the next plugin, got rcode %d msg %v", rcode, m)
+	}
+}
+
+func TestServeSessionCompression(t *testing.T) {
+	tests := []struct {
+		compression string
+		tcp         bool
+		expected    bool
+	}{
+		{"", false, true},
+		{"", true, false},
+		{compressionOff, false, false},
+		{compressionOff, true, false},
+		{compressionOn, false, true},
+		{compressionOn, true, true},
+	}
+	for _, tc := range tests {
+		session := newTestSession()
+		session.compression = tc.compression
+		addActiveHost(session.manager, "10.0.0.1", 1)
+		lb := LoadBalance{Next: test.NextHandler(dns.RcodeRefused, nil), session: session}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tc.tcp})
+		req := new(dns.Msg)
+		req.SetQuestion("lb.example.org.", dns.TypeA)
+		if _, err := lb.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if rec.Msg.Compress != tc.expected {
+			t.Errorf("Compression %q, TCP %v: Expected Compress %v, got %v", tc.compression, tc.tcp, tc.expected, rec.Msg.Compress)
+		}
+	}
+}
+
+func TestServeSessionFallbackNone(t *testing.T) {
+	session := newTestSession()
+	session.manager.fallback = fallbackNone
+	session.manager.Add(netip.MustParseAddr("10.0.0.1"))
+
+	if _, rcode := serveTestQuery(t, session, "lb.example.org.", dns.TypeA); rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL without active hosts, got %s", dns.RcodeToString[rcode])
+	}
+	session.bestEffort = true
+	if _, rcode := serveTestQuery(t, session, "lb.example.org.", dns.TypeA); rcode != dns.RcodeRefused {
+		t.Errorf("Expected the query passed through with %s, got %s", sessionBestEffort, dns.RcodeToString[rcode])
+	}
+	session.bestEffort = false
+
+	addActiveHost(session.manager, "10.0.0.2", 1)
+	m, rcode := serveTestQuery(t, session, "lb.example.org.", dns.TypeA)
+	if rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("Expected the active host answered, got %s %v", dns.RcodeToString[rcode], m)
+	}
+}
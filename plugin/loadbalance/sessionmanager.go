@@ -1,144 +1,1422 @@
 package loadbalance
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/netip"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/coredns/coredns/core/dnsserver"
+
+	"github.com/miekg/dns"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 )
 
 const (
 	// Scrape targets every 15s.
-	// Remove host from active if unavailable for 30+ seconds.
+	// Remove host from active if unavailable for 30+ seconds, two scrape
+	// intervals.
 	DefaultScrapeSeconds  = 15
 	DefaultTimeoutSeconds = 30
+	// Hosts with a health metric below this value are considered unhealthy.
+	DefaultHealthThreshold = 1
+	// Maximum number of concurrent scrapes on startup.
+	DefaultStartupParallelism = 16
+	// Retry scrapes failing to parse once, e.g. if truncated.
+	DefaultParseRetries = 1
+	// Retry transient scrape failures twice, after 100ms and 200ms.
+	DefaultRetries    = 2
+	DefaultRetryDelay = 100 * time.Millisecond
+	// Prefix length of subnets for the concurrent scrape limit and the
+	// client subsets.
+	DefaultSubnetBits = 24
+	// Scrape hosts on the HTTP port, if neither the host nor the pool have a
+	// scrape port.
+	DefaultScrapePort = 80
+	// Scrape hosts over HTTPS on the HTTPS port, if neither the host nor
+	// the pool have a scrape port.
+	DefaultTLSScrapePort = 443
+	// Scrape the metrics at the usual Prometheus path.
+	DefaultScrapePath = "/metrics"
+	// Close idle scrape connections after 90s, like the default transport.
+	DefaultIdleConnTimeout = 90 * time.Second
+	// Give up on scrape requests after 10s.
+	DefaultHTTPTimeout = 10 * time.Second
+	// Take the load percentile over the last 10 scrapes, 2.5 minutes at the
+	// scrape interval.
+	DefaultPercentileWindow = 10
+)
+
+// Read at most 64KiB of the rest of a scrape body, for the connection to be
+// reused. Longer bodies, e.g. over the scrape size limit, close it instead.
+const maxDrainBytes = 64 << 10
+
+// Schemes of the scrape URL.
+const (
+	scrapeSchemeHTTP  = "http"
+	scrapeSchemeHTTPS = "https"
+)
+
+// Selections of the hosts answered.
+const (
+	selectionLeast  = "least"
+	selectionRotate = "rotate"
+	// Rendezvous selection orders hosts by client preference, weighted by
+	// load.
+	selectionRendezvous = "rendezvous"
+	// Least-loaded answers are sorted by load, or shuffled weighted by the
+	// inverse load.
+	distributionSorted   = "sorted"
+	distributionWeighted = "weighted"
+)
+
+// Answers without active hosts.
+const (
+	// All known hosts, shuffled.
+	fallbackAll = "all"
+	// No hosts, for clients to fail over elsewhere.
+	fallbackNone = "none"
+	// The hosts last known to be active, even though they are stale.
+	fallbackLastKnown = "last_known"
+)
+
+// Built-in scrape formats. Other formats are supported with RegisterExtractor.
+const (
+	scrapeFormatPrometheus = "prometheus"
+	scrapeFormatJSON       = "json"
 )
 
 type SessionManager struct {
 	scrapeMetric          string
 	scrapePort            uint16
-	scrapeTimeoutSeconds  uint
 	scrapeIntervalSeconds uint
-	hosts                 map[netip.Addr]*Host
-	active                map[netip.Addr]*Host
+	// Hosts not successfully scraped for activeTimeoutSeconds leave the
+	// active set. This active window spans at least two scrape intervals, so
+	// a single slow or failed scrape doesn't flap hosts. It is unrelated to
+	// httpTimeout, the timeout of each scrape request.
+	activeTimeoutSeconds uint
+	// Optional weighted metrics, blended into the host load instead of
+	// scrapeMetric.
+	scrapeBlend []metricWeight
+	// Optional label values selecting a single series of scrapeMetric.
+	scrapeLabels map[string]string
+	// Optional quantile of a summary scrapeMetric, or upper bound of the
+	// histogram bucket of which the fraction of observations above is the
+	// load. Zero reads summaries and histograms as the average observation.
+	scrapeQuantile float64
+	scrapeBucket   float64
+	// If set, metrics not found by name are also looked up with the _total
+	// suffix of counters added or removed. The matched names are logged
+	// once.
+	metricSuffix  bool
+	suffixMatched map[string]bool
+	// Optional metric holding the maximum number of sessions of a host. If
+	// set, the load of a host is the percentage of its capacity in use.
+	capacityMetric string
+	// Optional health metric. Hosts reporting a value below the threshold
+	// are excluded from the active set, regardless of their load.
+	healthMetric    string
+	healthThreshold float64
+	// Optional width of the estimate tiers. Hosts in the least-loaded tier
+	// are shuffled, while the tiers themselves stay ordered.
+	tierWidth float32
+	// Optional window after which the pool falls back to random shuffle,
+	// if all scrapes have failed. Zero disables the fallback.
+	scrapeFailureWindow time.Duration
+	lastScrapeSuccess   time.Time
+	degraded            bool
+	// Number of retries of scrapes failing to parse.
+	parseRetries uint
+	// Number of retries of scrapes failing transiently, to connect or with
+	// a server error. The delay doubles after each retry.
+	retries    uint
+	retryDelay time.Duration
+	// Optional maximum size of the scraped metrics. Larger scrapes fail.
+	// Zero disables the limit.
+	scrapeMaxBytes int64
+	// Custom headers set on scrape requests.
+	scrapeHeaders http.Header
+	// Scheme and path of the scrape URL.
+	scrapeScheme string
+	scrapePath   string
+	// Client shared by all scrapes. Keeps one idle connection per host,
+	// closed after the idle timeout. Requests time out after httpTimeout,
+	// at most the scrape interval.
+	client      *http.Client
+	idleTimeout time.Duration
+	httpTimeout time.Duration
+	// Optional TLS settings of HTTPS scrapes. Targets are verified against
+	// the system roots, unless a CA bundle is given or verification is
+	// skipped for self-signed certificates.
+	tlsSkipVerify bool
+	tlsRootCAs    *x509.CertPool
+	// Scheduler of the scrapes. Scheduled scrapes stop once ctx is done.
+	scheduler Scheduler
+	ctx       context.Context
+	cancel    context.CancelFunc
+	// True once Start scheduled the hosts. Hosts added later by SetTargets
+	// are scheduled on their own.
+	started bool
+	// Format of the scraped metrics. For JSON, the metric is read from the
+	// field at the dot separated path.
+	scrapeFormat   string
+	scrapeJSONPath string
+	// Optional synchronous scrape of all hosts on startup, with bounded
+	// parallelism and an overall deadline. Zero deadline disables it.
+	startupParallelism uint
+	startupDeadline    time.Duration
+	// Prefer hosts in the subnets of the local interfaces, among hosts with
+	// the same estimate.
+	preferLocal   bool
+	localPrefixes []netip.Prefix
+	// Optional limit on concurrent scrapes of hosts in the same subnet.
+	subnetLimit uint
+	subnetBits  int
+	subnets     map[netip.Prefix]chan struct{}
+	subnetMutex sync.Mutex
+	// Optional size of the stable subset of active hosts answered to each
+	// client subnet. Zero answers with all active hosts.
+	subsetSize uint
+	subsetBits int
+	// Optional number of hosts answered, randomly sampled from the
+	// least-loaded tier on every query. Zero answers with all hosts.
+	sampleSize uint
+	// Optional change of an estimate, beyond which the hosts are sorted
+	// again. Until then, the last order is reused. Zero sorts on every query.
+	resortEpsilon float32
+	order         map[uint16][]*Host
+	// Optional ceiling on the estimate of a host, as a multiple of the
+	// scraped value and as an absolute value. This keeps the estimate of
+	// the first host from growing without bound, if scrapes stop.
+	estimateFactor float32
+	estimateMax    float32
+	// Optional half-life of the answered sessions in the estimates. The
+	// estimate of a host decays towards the scraped value, so it recovers
+	// even if scrapes are sparse or failing. Zero disables the decay.
+	estimateHalfLife time.Duration
+	// Selection of the hosts answered. Least-loaded by default, a rotation
+	// of the active set, or the preference of the client subnet weighted by
+	// load.
+	selection string
+	rotation  uint64
+	// Optional number of least-loaded hosts taking turns at the head of
+	// least-loaded answers. Zero or one keeps the least-loaded host first.
+	headRotation  uint
+	headRotations uint64
+	// Optional number of random other active hosts answered after the
+	// least-loaded host, exploring beyond the strict order. Zero answers
+	// all hosts by load.
+	exploreCount uint
+	// Random number generator of the shuffles, seeded once.
+	rng *lockedRand
+	// Order of least-loaded answers. Sorted by load by default, or a
+	// shuffle weighted by the inverse load, so bursts of queries spread
+	// before the estimates catch up.
+	distribution string
+	// Answer without active hosts. All known hosts by default.
+	fallback string
+	// Hosts active since the active set was last empty, the last known
+	// active set once it is empty again.
+	lastActive map[netip.Addr]*Host
+	// Optional maximum answer size, filled by repeating each host in
+	// proportion to its inverse load. Zero answers every host once.
+	repeatMax uint
+	// Maximum number of hosts repeated, the maximum answers of the pool.
+	// Zero repeats all hosts.
+	repeatHosts uint
+	// Optional daily maintenance window, during which all hosts are
+	// answered shuffled, without steering.
+	maintenance *window
+	// Current time of the maintenance window, the estimate decay and the
+	// active timeout. Replaced in tests and simulations.
+	now func() time.Time
+	// Optional minimum number of hosts answered. If fewer hosts are active,
+	// the most recently seen inactive hosts are added up to the floor.
+	activeFloor uint
+	// Optional webhook notified of active set changes.
+	webhook *webhook
+	// Name of the pool in metrics, the hostname of the session policy.
+	name string
+	// Optional number of active hosts for the pool to be ready. Zero waits
+	// for all hosts to be scraped, successfully or not.
+	readyQuorum uint
+	// Number of hosts not scraped since Start. The pool is ready once all
+	// hosts have been scraped, successfully or not.
+	unscraped int64
+	// Optional ceiling on the number of scrapes per second across all hosts.
+	// The per-host scrape interval stretches to stay under it. Zero disables
+	// the ceiling.
+	scrapeBudget float64
+	// Moving average of the scrape duration, in nanoseconds.
+	scrapeDuration int64
+	// Number of scrapes since Start. A scrape generation passes once as many
+	// scrapes as hosts completed.
+	scrapes uint64
+	// Reorder the least-loaded tier once per scrape generation, instead of
+	// on every query. The order is stable within a scrape interval, and
+	// fair over time.
+	generationJitter bool
+	// Optional ceiling on the rate of counter metrics. Scrapes above the
+	// ceiling are ignored as anomalies.
+	maxRate float64
+	// Optional percentile of the last percentileWindow scraped values of a
+	// host, used as its load instead of the last value. This smooths spikes
+	// of noisy metrics, while following sustained load. Zero uses the last
+	// value.
+	percentile       float64
+	percentileWindow int
+	// Optional DNS name, resolved every targetDNSInterval to the target
+	// hosts, in addition to the static targets. The name is looked up via
+	// CoreDNS itself, on the server of the first query.
+	targetDNS         string
+	targetDNSInterval time.Duration
+	staticTargets     []netip.Addr
+	lookup            func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+	server            atomic.Pointer[dnsserver.Server]
+	serverKnown       chan struct{}
+	// Guards the hosts, the active set, the cached order, the degraded
+	// state and the scraped state of the hosts. Scrapes only lock to store
+	// their results, not while fetching the metrics.
+	mutex  sync.RWMutex
+	hosts  map[netip.Addr]*Host
+	active map[netip.Addr]*Host
+}
+
+// window is a daily time of day range, as offsets from midnight. Windows
+// ending before they start span midnight.
+type window struct {
+	start, end time.Duration
+}
+
+// contains returns true if the time of day of t is in the window.
+func (w *window) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if w.start <= w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// metricWeight is a scraped metric and its weight in the blended host load.
+type metricWeight struct {
+	name   string
+	weight float64
 }
 
 type Host struct {
 	ip netip.Addr
-	// Prometheus port and metric name scrape.
+	// The ip as returned in answers, converted once.
+	netIP net.IP
+	// Port of the metrics endpoint.
 	port uint16
 	// Scraped base value and last update time.
 	base    float32
 	updated time.Time
-	// Current estimated value.
-	estimate float32
+	// Current estimated value, and the estimate when last sorted.
+	estimate       float32
+	sortedEstimate float32
+	// Time the estimate last decayed.
+	decayed time.Time
+	// Ring buffer of the last scraped values, for the load percentile.
+	window     []float64
+	windowNext int
+	// Last sample of a counter scrape metric and its time, to compute the
+	// rate of the counter.
+	counter     float64
+	counterTime time.Time
+	// Number of samples scraped, including the baselines of counter rates
+	// not updating the load.
+	samples uint64
+	// Draining hosts are scraped, but left out of answers.
+	draining bool
+	// True once the scheduler scraped the host.
+	scheduled bool
+	// Closed once the host is removed from the targets, to stop its scrapes.
+	removed chan struct{}
+	// Last scraped capacity, if the pool has a capacity metric.
+	capacity float64
+	// True if the host is in a subnet of a local interface.
+	local bool
+	// Result of the last health metric scrape.
+	healthy bool
 }
 
 func (host *Host) Update(value float32) {
+	host.updateAt(value, time.Now())
+}
+
+// updateAt sets the host to value, scraped at now.
+func (host *Host) updateAt(value float32, now time.Time) {
 	host.base = value
 	host.estimate = value
-	host.updated = time.Now()
+	host.updated = now
+	host.decayed = host.updated
 }
 
-// Active returns true if host was updated in the last <interval> seconds.
-func (host *Host) Active(interval uint) bool {
-	return time.Since(host.updated).Seconds() < float64(interval)
+// observe adds value to the last size scraped values of the host, and
+// returns their p-th percentile.
+func (host *Host) observe(value float64, size int, p float64) float64 {
+	if len(host.window) < size {
+		host.window = append(host.window, value)
+	} else {
+		host.window[host.windowNext] = value
+		host.windowNext = (host.windowNext + 1) % size
+	}
+	return percentile(host.window, p)
+}
+
+// counterRate returns the per second increase of a counter since the
+// previous sample, and keeps value as the next baseline. Returns false for
+// the first sample, and after a counter reset.
+func (host *Host) counterRate(value float64, now time.Time) (float64, bool) {
+	previous, at := host.counter, host.counterTime
+	host.counter, host.counterTime = value, now
+	if at.IsZero() || value < previous {
+		return 0, false
+	}
+	elapsed := now.Sub(at).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return (value - previous) / elapsed, true
+}
+
+// percentile returns the p-th percentile of values, by the nearest rank.
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Active returns true if host was updated in the last <interval> seconds
+// before now.
+func (host *Host) Active(now time.Time, interval uint) bool {
+	return now.Sub(host.updated).Seconds() < float64(interval)
 }
 
 func NewSessionManager() *SessionManager {
-	return &SessionManager{
-		scrapeTimeoutSeconds:  DefaultTimeoutSeconds,
+	ctx, cancel := context.WithCancel(context.Background())
+	sm := &SessionManager{
+		ctx:                   ctx,
+		cancel:                cancel,
+		now:                   time.Now,
+		activeTimeoutSeconds:  DefaultTimeoutSeconds,
 		scrapeIntervalSeconds: DefaultScrapeSeconds,
+		healthThreshold:       DefaultHealthThreshold,
+		scrapeHeaders:         make(http.Header),
+		client:                newScrapeClient(DefaultHTTPTimeout, DefaultIdleConnTimeout, nil),
+		idleTimeout:           DefaultIdleConnTimeout,
+		httpTimeout:           DefaultHTTPTimeout,
+		scrapeFormat:          scrapeFormatPrometheus,
+		scrapeScheme:          scrapeSchemeHTTP,
+		scrapePath:            DefaultScrapePath,
+		scheduler:             LoopScheduler{},
+		selection:             selectionLeast,
+		distribution:          distributionSorted,
+		fallback:              fallbackAll,
+		lastActive:            make(map[netip.Addr]*Host),
+		rng:                   newLockedRand(time.Now().UnixNano()),
+		rotation:              rand.Uint64(),
+		parseRetries:          DefaultParseRetries,
+		retries:               DefaultRetries,
+		retryDelay:            DefaultRetryDelay,
+		percentileWindow:      DefaultPercentileWindow,
+		targetDNSInterval:     DefaultTargetDNSInterval,
+		serverKnown:           make(chan struct{}),
+		startupParallelism:    DefaultStartupParallelism,
+		subnetBits:            DefaultSubnetBits,
+		subsetBits:            DefaultSubnetBits,
+		subnets:               make(map[netip.Prefix]chan struct{}),
 		hosts:                 make(map[netip.Addr]*Host),
 		active:                make(map[netip.Addr]*Host),
 	}
+	sm.lookup = sm.lookupUpstream
+	sm.lastScrapeSuccess = sm.now()
+	return sm
+}
+
+// newScrapeClient returns a client reusing one connection per host, for
+// exporters supporting keep-alive. Requests time out after timeout. Idle
+// connections are closed after idleTimeout, so they don't pile up for
+// rarely scraped hosts. A nil tlsConfig uses the default TLS settings.
+func newScrapeClient(timeout, idleTimeout time.Duration, tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = 1
+	transport.IdleConnTimeout = idleTimeout
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
 }
 
 // getMetricValue is a helper function to extract the value from a metric.
 func getMetricValue(mf *dto.MetricFamily) (float64, error) {
+	return getSeriesValue(mf, nil, 0, 0)
+}
+
+// getSeriesValue extracts the value of the series of the metric with the
+// given label values. Without labels, the first series is used. Returns an
+// error unless exactly one series matches. Summaries are read at quantile,
+// and histograms as the fraction of observations above the bucket with the
+// upper bound bucket. If zero, they are read as the average observation.
+func getSeriesValue(mf *dto.MetricFamily, labels map[string]string, quantile, bucket float64) (float64, error) {
+	series, err := selectSeries(mf, labels)
+	if err != nil {
+		return 0, err
+	}
 	switch {
 	case mf.GetType() == dto.MetricType_GAUGE:
-		gauge := mf.GetMetric()[0].GetGauge()
+		gauge := series.GetGauge()
 		return *gauge.Value, nil
 	case mf.GetType() == dto.MetricType_COUNTER:
-		counter := mf.GetMetric()[0].GetCounter()
+		counter := series.GetCounter()
 		return *counter.Value, nil
+	case mf.GetType() == dto.MetricType_SUMMARY:
+		return getSummaryValue(mf.GetName(), series.GetSummary(), quantile)
+	case mf.GetType() == dto.MetricType_HISTOGRAM:
+		return getHistogramValue(mf.GetName(), series.GetHistogram(), bucket)
 	default:
 		return 0, fmt.Errorf("Unsupported metric type: %v", mf)
 	}
 }
 
-func (sm *SessionManager) ScrapeLoop(host *Host) {
-	for {
-		start := time.Now()
-		sm.Scrape(host)
-		// Update active host status.
-		if host.Active(sm.scrapeTimeoutSeconds) {
-			log.Infof("Add %v to active list.", host.ip)
-			sm.active[host.ip] = host
-		} else {
-			log.Infof("Remove %v from active list.", host.ip)
-			delete(sm.active, host.ip)
+// getSummaryValue returns the value of the summary at quantile, or the
+// average observation if quantile is zero.
+func getSummaryValue(name string, summary *dto.Summary, quantile float64) (float64, error) {
+	if quantile == 0 {
+		return average(summary.GetSampleSum(), summary.GetSampleCount()), nil
+	}
+	quantiles := make([]float64, 0, len(summary.GetQuantile()))
+	for _, q := range summary.GetQuantile() {
+		if q.GetQuantile() != quantile {
+			quantiles = append(quantiles, q.GetQuantile())
+			continue
+		}
+		if math.IsNaN(q.GetValue()) {
+			// No observations in the window of the summary.
+			return 0, fmt.Errorf("metric %s has no value at quantile %v", name, quantile)
+		}
+		return q.GetValue(), nil
+	}
+	return 0, fmt.Errorf("metric %s has no quantile %v, only %v", name, quantile, quantiles)
+}
+
+// getHistogramValue returns the fraction of the observations of the
+// histogram above the bucket with the upper bound bucket, or the average
+// observation if bucket is zero.
+func getHistogramValue(name string, histogram *dto.Histogram, bucket float64) (float64, error) {
+	if bucket == 0 {
+		return average(histogram.GetSampleSum(), histogram.GetSampleCount()), nil
+	}
+	bounds := make([]float64, 0, len(histogram.GetBucket()))
+	for _, b := range histogram.GetBucket() {
+		if b.GetUpperBound() != bucket {
+			bounds = append(bounds, b.GetUpperBound())
+			continue
+		}
+		if histogram.GetSampleCount() == 0 {
+			return 0, nil
+		}
+		return 1 - float64(b.GetCumulativeCount())/float64(histogram.GetSampleCount()), nil
+	}
+	return 0, fmt.Errorf("metric %s has no bucket %v, only %v", name, bucket, bounds)
+}
+
+// average returns sum over count, or zero without observations.
+func average(sum float64, count uint64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// selectSeries returns the single series of the metric matching all labels.
+func selectSeries(mf *dto.MetricFamily, labels map[string]string) (*dto.Metric, error) {
+	if len(labels) == 0 {
+		if len(mf.GetMetric()) == 0 {
+			return nil, fmt.Errorf("metric %s has no series", mf.GetName())
+		}
+		return mf.GetMetric()[0], nil
+	}
+	var selected *dto.Metric
+	for _, series := range mf.GetMetric() {
+		if !matchLabels(series, labels) {
+			continue
+		}
+		if selected != nil {
+			return nil, fmt.Errorf("metric %s has more than one series with labels %v", mf.GetName(), labels)
+		}
+		selected = series
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("metric %s has no series with labels %v", mf.GetName(), labels)
+	}
+	return selected, nil
+}
+
+// matchLabels returns true if the series has all the label values.
+func matchLabels(series *dto.Metric, labels map[string]string) bool {
+	matched := 0
+	for _, pair := range series.GetLabel() {
+		if value, ok := labels[pair.GetName()]; ok {
+			if value != pair.GetValue() {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(labels)
+}
+
+// getJSONValue is a helper function to extract a numeric field from a JSON
+// document. The path is a dot separated list of object keys.
+func getJSONValue(body io.Reader, path string) (float64, error) {
+	var doc interface{}
+	if err := json.NewDecoder(body).Decode(&doc); err != nil {
+		return 0, err
+	}
+	for _, key := range strings.Split(path, ".") {
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("JSON path %s: %s is not in an object", path, key)
+		}
+		doc, ok = object[key]
+		if !ok {
+			return 0, fmt.Errorf("JSON path %s: %s not found", path, key)
+		}
+	}
+	value, ok := doc.(float64)
+	if !ok {
+		return 0, fmt.Errorf("JSON path %s: %v is not a number", path, doc)
+	}
+	return value, nil
+}
+
+// scrapeScheduled scrapes the host and updates the active set. Called by
+// the scheduler.
+func (sm *SessionManager) scrapeScheduled(host *Host) {
+	select {
+	case <-host.removed:
+		return
+	default:
+	}
+	start := time.Now()
+	sm.scrapeContext(sm.ctx, host)
+	if sm.ctx.Err() != nil {
+		// Stopped mid-scrape.
+		return
+	}
+	sm.recordScrapeDuration(time.Since(start))
+	atomic.AddUint64(&sm.scrapes, 1)
+	sm.updateActive(host)
+	sm.checkDegraded()
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.markScheduled(host)
+}
+
+// markScheduled marks the host scraped by the scheduler, counting down the
+// hosts holding up readiness. Must be called with the write lock held.
+func (sm *SessionManager) markScheduled(host *Host) {
+	if !host.scheduled {
+		host.scheduled = true
+		atomic.AddInt64(&sm.unscraped, -1)
+	}
+}
+
+// recordScrapeDuration adds the duration of a scrape to the moving average.
+func (sm *SessionManager) recordScrapeDuration(d time.Duration) {
+	average := atomic.LoadInt64(&sm.scrapeDuration)
+	if average == 0 {
+		average = int64(d)
+	} else {
+		average += (int64(d) - average) / 8
+	}
+	atomic.StoreInt64(&sm.scrapeDuration, average)
+}
+
+// scrapeInterval returns the effective per-host scrape interval. With a
+// scrape budget, the interval stretches with the number of hosts to keep the
+// scrape rate under the budget, and never drops below the average scrape
+// duration.
+func (sm *SessionManager) scrapeInterval() time.Duration {
+	interval := time.Duration(sm.scrapeIntervalSeconds) * time.Second
+	if sm.scrapeBudget <= 0 {
+		return interval
+	}
+	spread := time.Duration(float64(len(sm.hosts)) / sm.scrapeBudget * float64(time.Second))
+	if spread > interval {
+		interval = spread
+	}
+	if average := time.Duration(atomic.LoadInt64(&sm.scrapeDuration)); average > interval {
+		interval = average
+	}
+	return interval
+}
+
+// activeTimeout returns the number of seconds a host stays active after a
+// successful scrape. With a scrape budget, the timeout stretches along with
+// the scrape interval, so hosts aren't dropped between scrapes.
+func (sm *SessionManager) activeTimeout() uint {
+	timeout := sm.activeTimeoutSeconds
+	if sm.scrapeBudget <= 0 {
+		return timeout
+	}
+	stretched := uint(math.Ceil(2 * sm.scrapeInterval().Seconds()))
+	if stretched > timeout {
+		timeout = stretched
+	}
+	return timeout
+}
+
+// Reasons of hosts joining or leaving the active list.
+const (
+	reasonScraped   = "scraped"
+	reasonTimeout   = "scrape timeout"
+	reasonUnhealthy = "health metric"
+	reasonRemoved   = "removed from targets"
+)
+
+// updateActive adds or removes the host from the active list, based on
+// the last scrape. Changes are logged with their reason.
+func (sm *SessionManager) updateActive(host *Host) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if sm.hosts[host.ip] != host {
+		// Removed from the targets mid-scrape.
+		return
+	}
+	_, wasActive := sm.active[host.ip]
+	reason := reasonScraped
+	switch {
+	case !host.Active(sm.now(), sm.activeTimeout()):
+		reason = reasonTimeout
+	case !host.healthy:
+		reason = reasonUnhealthy
+	}
+	active := reason == reasonScraped
+	if active == wasActive {
+		return
+	}
+	sm.setActive(host, active, reason)
+}
+
+// setActive adds or removes the host from the active list, and notifies the
+// change. Must be called with the write lock held.
+func (sm *SessionManager) setActive(host *Host, active bool, reason string) {
+	if active {
+		log.Infof("Add %v to active list. reason: %s", host.ip, reason)
+		if len(sm.active) == 0 {
+			// A new active set, replacing the last known one.
+			sm.lastActive = make(map[netip.Addr]*Host)
+		}
+		sm.active[host.ip] = host
+		sm.lastActive[host.ip] = host
+	} else {
+		log.Infof("Remove %v from active list. reason: %s", host.ip, reason)
+		delete(sm.active, host.ip)
+	}
+	// The cached order no longer holds the active hosts.
+	sm.order = nil
+	sessionActiveHosts.WithLabelValues(sm.name).Set(float64(len(sm.active)))
+	if sm.webhook != nil {
+		sm.webhook.notify(activeChange{Host: host.ip.String(), Active: active, Reason: reason, Time: sm.now()})
+	}
+}
+
+// checkDegraded switches the pool to random shuffle if all scrapes have
+// failed for longer than the scrape failure window, and back once any
+// scrape succeeds.
+func (sm *SessionManager) checkDegraded() {
+	if sm.scrapeFailureWindow == 0 {
+		return
+	}
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	failing := sm.now().Sub(sm.lastScrapeSuccess) > sm.scrapeFailureWindow
+	if failing && !sm.degraded {
+		log.Warningf("All scrapes failed since %v. Falling back to random shuffle.",
+			sm.lastScrapeSuccess.Format(time.RFC3339))
+	}
+	if !failing && sm.degraded {
+		log.Infof("Scrapes recovered. Resuming session based load balancing.")
+	}
+	sm.degraded = failing
+}
+
+// family returns the scraped metric family of name. With metricSuffix, the
+// _total suffix of counters is added or removed if name is not found.
+func (sm *SessionManager) family(metrics map[string]*dto.MetricFamily, name string) (*dto.MetricFamily, bool) {
+	if mf, ok := metrics[name]; ok || !sm.metricSuffix {
+		return mf, ok
+	}
+	variant := name + "_total"
+	if trimmed, ok := strings.CutSuffix(name, "_total"); ok {
+		variant = trimmed
+	}
+	mf, ok := metrics[variant]
+	if ok && !sm.suffixMatched[name] {
+		log.Infof("Metric %s not found. Using %s.", name, variant)
+		if sm.suffixMatched == nil {
+			sm.suffixMatched = map[string]bool{}
 		}
-		timeLeft := float64(sm.scrapeIntervalSeconds) - time.Since(start).Seconds()
-		time.Sleep(time.Duration(timeLeft) * time.Second)
+		sm.suffixMatched[name] = true
+	}
+	return mf, ok
+}
+
+// checkHealth updates the host health from the scraped metrics. Hosts are
+// always healthy if no health metric is configured.
+func (sm *SessionManager) checkHealth(host *Host, metrics map[string]*dto.MetricFamily) {
+	if sm.healthMetric == "" {
+		host.healthy = true
+		return
+	}
+	mf, ok := sm.family(metrics, sm.healthMetric)
+	if !ok {
+		log.Errorf("Health metric %s not found. host: %s", sm.healthMetric, host.ip)
+		host.healthy = false
+		return
+	}
+	value, err := getMetricValue(mf)
+	if err != nil {
+		log.Errorf("%v", err)
+		host.healthy = false
+		return
 	}
+	host.healthy = value >= sm.healthThreshold
 }
 
 func (sm *SessionManager) Scrape(host *Host) {
-	url := fmt.Sprintf("http://%s:%d/metrics", host.ip, host.port)
-	client := http.Client{
-		Timeout: 10 * time.Second,
-	}
-	resp, err := client.Get(url)
-	if err == nil {
-		var parser expfmt.TextParser
-		metrics, err := parser.TextToMetricFamilies(resp.Body)
+	sm.scrapeContext(context.Background(), host)
+}
+
+// subnetSlots returns the channel limiting concurrent scrapes of hosts in
+// the subnet of ip.
+func (sm *SessionManager) subnetSlots(ip netip.Addr) chan struct{} {
+	bits := sm.subnetBits
+	if bits > ip.BitLen() {
+		bits = ip.BitLen()
+	}
+	subnet, _ := ip.Prefix(bits)
+	sm.subnetMutex.Lock()
+	defer sm.subnetMutex.Unlock()
+	slots, ok := sm.subnets[subnet]
+	if !ok {
+		slots = make(chan struct{}, sm.subnetLimit)
+		sm.subnets[subnet] = slots
+	}
+	return slots
+}
+
+// scrapeContext scrapes the host, aborting the scrape when ctx is done.
+// Scrapes failing to parse, e.g. truncated by a dropped connection, are
+// retried up to parseRetries times.
+func (sm *SessionManager) scrapeContext(ctx context.Context, host *Host) {
+	if sm.subnetLimit > 0 {
+		slots := sm.subnetSlots(host.ip)
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			log.Errorf("Failed to scrape host: %s err: %v", host.ip, ctx.Err())
+			return
+		}
+	}
+	samples := sm.samplesOf(host)
+	defer func() {
+		// Scrapes aborted by Stop are not failures.
+		if ctx.Err() == nil && sm.samplesOf(host) == samples {
+			sessionScrapeFailures.WithLabelValues(host.ip.String()).Inc()
+		}
+		select {
+		case <-host.removed:
+			// Removed mid-scrape, drop the series the scrape brought back.
+			deleteHostMetrics(host.ip.String())
+		default:
+		}
+	}()
+	start := time.Now()
+	var parseAttempts, attempts uint
+	for {
+		err := sm.scrapeAttempt(ctx, host)
+		var transient *transientError
+		switch {
+		case err == nil:
+			if parseAttempts > 0 {
+				log.Infof("Scrape retry succeeded. Transient parse error. host: %s", host.ip)
+			}
+			if attempts > 0 {
+				log.Infof("Scrape retry succeeded. Transient error. host: %s", host.ip)
+			}
+			return
+		case errors.As(err, &transient):
+			// Exponential backoff, bounded by the scrape interval.
+			delay := sm.retryDelay << attempts
+			if attempts == sm.retries || time.Since(start)+delay > sm.scrapeInterval() {
+				log.Errorf("Failed to get metrics. host: %s err: %v", host.ip, err)
+				return
+			}
+			attempts++
+			log.Warningf("Failed to get metrics. Retrying in %v. host: %s err: %v", delay, host.ip, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				log.Errorf("Failed to get metrics. host: %s err: %v", host.ip, ctx.Err())
+				return
+			}
+		default:
+			if parseAttempts == sm.parseRetries {
+				log.Errorf("Failed to parse metrics. host: %s err: %v", host.ip, err)
+				sessionScrapeParseErrors.WithLabelValues(host.ip.String()).Inc()
+				return
+			}
+			parseAttempts++
+			log.Warningf("Failed to parse metrics. Retrying. host: %s err: %v", host.ip, err)
+			sessionScrapeRetries.WithLabelValues(host.ip.String()).Inc()
+		}
+	}
+}
+
+// scrapeURL returns the URL of the metrics of the host.
+func (sm *SessionManager) scrapeURL(host *Host) string {
+	return fmt.Sprintf("%s://%s%s", sm.scrapeScheme, netip.AddrPortFrom(host.ip, host.port), sm.scrapePath)
+}
+
+// tlsConfig returns the TLS settings of HTTPS scrapes, or nil for the
+// defaults.
+func (sm *SessionManager) tlsConfig() *tls.Config {
+	if !sm.tlsSkipVerify && sm.tlsRootCAs == nil {
+		return nil
+	}
+	return &tls.Config{
+		InsecureSkipVerify: sm.tlsSkipVerify,
+		RootCAs:            sm.tlsRootCAs,
+	}
+}
+
+// transientError is a scrape error worth retrying, e.g. a refused or reset
+// connection, or a server error.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+
+func (e *transientError) Unwrap() error { return e.err }
+
+// scrapeAttempt fetches and parses the metrics of the host once. Returns an
+// error if the metrics failed to parse, or a transientError if they could
+// not be fetched. Other errors are logged.
+func (sm *SessionManager) scrapeAttempt(ctx context.Context, host *Host) error {
+	url := sm.scrapeURL(host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		log.Errorf("Failed to create scrape request. host: %s err: %v", host.ip, err)
+		return nil
+	}
+	for key, values := range sm.scrapeHeaders {
+		req.Header[key] = values
+	}
+	resp, err := sm.client.Do(req)
+	if err != nil {
+		return &transientError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return &transientError{fmt.Errorf("HTTP status %s", resp.Status)}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// Client errors, e.g. a wrong path or missing credentials, persist,
+		// so they are not retried.
+		log.Errorf("Failed to get metrics. host: %s err: HTTP status %s", host.ip, resp.Status)
+		return nil
+	}
+	body := &countingReader{r: resp.Body}
+	defer func() {
+		// Read the rest of the body, for the connection to be reused.
+		io.CopyN(io.Discard, body, maxDrainBytes)
+		sessionScrapeBytes.WithLabelValues(host.ip.String()).Add(float64(body.n))
+	}()
+	var metrics io.Reader = body
+	if sm.scrapeMaxBytes > 0 {
+		data, err := io.ReadAll(io.LimitReader(body, sm.scrapeMaxBytes+1))
 		if err != nil {
-			log.Errorf("Failed to parse metrics. err: %v", err)
+			log.Errorf("Failed to read metrics. host: %s err: %v", host.ip, err)
+			return nil
 		}
-		for k, mf := range metrics {
-			if k == sm.scrapeMetric {
-				value, err := getMetricValue(mf)
-				if err != nil {
-					log.Errorf("%v", err)
-					continue
-				}
-				host.Update(float32(value))
+		if int64(len(data)) > sm.scrapeMaxBytes {
+			log.Errorf("Metrics larger than %d bytes. host: %s", sm.scrapeMaxBytes, host.ip)
+			return nil
+		}
+		metrics = bytes.NewReader(data)
+	}
+	if sm.scrapeFormat == scrapeFormatPrometheus {
+		// Health, blended and capacity metrics need all metric families,
+		// and counters their type.
+		return sm.scrapePrometheus(host, metrics)
+	}
+	metric := sm.scrapeMetric
+	if sm.scrapeFormat == scrapeFormatJSON {
+		metric = sm.scrapeJSONPath
+	}
+	value, err := extractors[sm.scrapeFormat].Extract(metrics, metric)
+	if err != nil {
+		return err
+	}
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	host.healthy = true
+	sm.update(host, value)
+	return nil
+}
 
-			}
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// scrapePrometheus updates the host from metrics in the Prometheus text
+// format. Returns an error if the metrics failed to parse, or the scrape
+// metric is missing.
+func (sm *SessionManager) scrapePrometheus(host *Host, body io.Reader) error {
+	var parser expfmt.TextParser
+	metrics, err := parser.TextToMetricFamilies(body)
+	if err != nil {
+		return err
+	}
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.checkHealth(host, metrics)
+	var value float64
+	if len(sm.scrapeBlend) > 0 {
+		var ok bool
+		if value, ok = sm.blend(host, metrics); !ok {
+			return nil
 		}
 	} else {
-		log.Errorf("Failed to get metrics. host: %s err: %v", host.ip, err)
+		mf, ok := sm.family(metrics, sm.scrapeMetric)
+		if !ok {
+			return fmt.Errorf("metric %s not found", sm.scrapeMetric)
+		}
+		if value, err = getSeriesValue(mf, sm.scrapeLabels, sm.scrapeQuantile, sm.scrapeBucket); err != nil {
+			return err
+		}
+		// The session count of a counter is its rate, e.g. of new sessions,
+		// over the actual time between the samples. Samples are timed by
+		// their timestamp if exposed, or else by the scrape.
+		if mf.GetType() == dto.MetricType_COUNTER {
+			at := sm.now()
+			if series, _ := selectSeries(mf, sm.scrapeLabels); series.TimestampMs != nil {
+				at = time.UnixMilli(series.GetTimestampMs())
+			}
+			if value, ok = host.counterRate(value, at); !ok {
+				// The sample is the baseline of the rate. The host stays
+				// unscored, but the scrape didn't fail.
+				sm.sampled(host)
+				return nil
+			}
+			if sm.maxRate > 0 && value > sm.maxRate {
+				log.Warningf("Implausible rate %.1f/s for host %s. Keeping previous estimate %v.",
+					value, host.ip, host.estimate)
+				return nil
+			}
+		}
+	}
+	if sm.capacityMetric != "" {
+		capacity, ok := sm.capacity(host, metrics)
+		if !ok {
+			return nil
+		}
+		host.capacity = capacity
+		value = 100 * value / capacity
 	}
+	sm.update(host, value)
+	return nil
+}
+
+// capacity returns the value of the capacity metric of the host. Returns
+// false if the metric is missing or not positive.
+func (sm *SessionManager) capacity(host *Host, metrics map[string]*dto.MetricFamily) (float64, bool) {
+	mf, ok := sm.family(metrics, sm.capacityMetric)
+	if !ok {
+		log.Errorf("Metric %s not found. host: %s", sm.capacityMetric, host.ip)
+		return 0, false
+	}
+	capacity, err := getMetricValue(mf)
+	if err != nil {
+		log.Errorf("%v", err)
+		return 0, false
+	}
+	if capacity <= 0 {
+		log.Errorf("Metric %s is %v, not positive. host: %s", sm.capacityMetric, capacity, host.ip)
+		return 0, false
+	}
+	return capacity, true
+}
+
+// blend returns the weighted sum of the blended metrics. Returns false if
+// any of the metrics is missing.
+func (sm *SessionManager) blend(host *Host, metrics map[string]*dto.MetricFamily) (float64, bool) {
+	sum := 0.0
+	for _, metric := range sm.scrapeBlend {
+		mf, ok := sm.family(metrics, metric.name)
+		if !ok {
+			log.Errorf("Metric %s not found. host: %s", metric.name, host.ip)
+			return 0, false
+		}
+		value, err := getMetricValue(mf)
+		if err != nil {
+			log.Errorf("%v", err)
+			return 0, false
+		}
+		sum += metric.weight * value
+	}
+	return sum, true
+}
+
+// update sets the host to a freshly scraped value.
+func (sm *SessionManager) update(host *Host, value float64) {
+	now := sm.now()
+	if sm.percentile > 0 {
+		value = host.observe(value, sm.percentileWindow, sm.percentile)
+	}
+	host.updateAt(float32(value), now)
+	sm.sampled(host)
+	sessionHostEstimate.WithLabelValues(host.ip.String()).Set(value)
+	sessionLastScrape.WithLabelValues(host.ip.String()).Set(float64(host.updated.UnixNano()) / 1e9)
 }
 
 func (sm *SessionManager) Add(addr netip.Addr) {
+	sm.AddPort(addr, 0)
+}
+
+// AddPort adds a host scraped on port. With port 0, the host is scraped on
+// the scrape port of the pool.
+func (sm *SessionManager) AddPort(addr netip.Addr, port uint16) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
 	if _, ok := sm.hosts[addr]; ok {
 		return
 	}
-	host := &Host{
+	host := newHost(addr, port)
+	host.local = sm.isLocal(addr)
+	sm.hosts[addr] = host
+}
+
+// Remove removes the host at addr, if any. The host leaves the answers, and
+// its scrapes stop.
+func (sm *SessionManager) Remove(addr netip.Addr) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if host, ok := sm.hosts[addr.Unmap()]; ok {
+		sm.removeHost(host)
+		log.Infof("Removed host %s.", host.ip)
+	}
+}
+
+// removeHost removes host from the hosts and the active set, stops its
+// scrapes, and deletes its metrics. Must hold the lock.
+func (sm *SessionManager) removeHost(host *Host) {
+	if _, ok := sm.active[host.ip]; ok {
+		sm.setActive(host, false, reasonRemoved)
+	}
+	sm.markScheduled(host)
+	close(host.removed)
+	delete(sm.hosts, host.ip)
+	delete(sm.lastActive, host.ip)
+	deleteHostMetrics(host.ip.String())
+}
+
+func newHost(addr netip.Addr, port uint16) *Host {
+	return &Host{
 		ip:       addr,
-		port:     0,
+		netIP:    net.IP(addr.AsSlice()),
+		port:     port,
 		updated:  time.Unix(0, 0),
 		base:     0,
 		estimate: 0,
+		removed:  make(chan struct{}),
 	}
-	sm.hosts[addr] = host
+}
+
+// SetTargets reconciles the hosts to exactly addrs, e.g. from service
+// discovery. New hosts are scraped on the scrape port of the pool, and
+// don't hold up readiness once started. Removed hosts leave the answers,
+// and their scrapes stop.
+func (sm *SessionManager) SetTargets(addrs []netip.Addr) {
+	sm.mutex.Lock()
+	targets := make(map[netip.Addr]bool, len(addrs))
+	added := []*Host{}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		targets[addr] = true
+		if _, ok := sm.hosts[addr]; ok {
+			continue
+		}
+		host := newHost(addr, 0)
+		host.local = sm.isLocal(addr)
+		if sm.started {
+			host.port = sm.defaultPort()
+			host.scheduled = true
+		}
+		sm.hosts[addr] = host
+		added = append(added, host)
+	}
+	removed := 0
+	for addr, host := range sm.hosts {
+		if targets[addr] {
+			continue
+		}
+		sm.removeHost(host)
+		removed++
+	}
+	started := sm.started
+	sm.mutex.Unlock()
+	log.Infof("Set targets. Added %d hosts, removed %d.", len(added), removed)
+	if started && len(added) > 0 {
+		sm.scheduler.Schedule(sm.ctx, added, sm.scrapeScheduled, sm.scrapeInterval, 0)
+	}
+}
+
+// defaultPort returns the scrape port of hosts without a port of their own.
+func (sm *SessionManager) defaultPort() uint16 {
+	if sm.scrapePort != 0 {
+		return sm.scrapePort
+	}
+	if sm.scrapeScheme == scrapeSchemeHTTPS {
+		return DefaultTLSScrapePort
+	}
+	return DefaultScrapePort
 }
 
 func (sm *SessionManager) Start() {
+	sm.setDefaultPorts()
+	if sm.preferLocal {
+		sm.localPrefixes = interfacePrefixes()
+		sm.markLocal()
+	}
+	unscraped := 0
+	for _, host := range sm.hosts {
+		if !host.scheduled {
+			unscraped++
+		}
+	}
+	atomic.StoreInt64(&sm.unscraped, int64(unscraped))
+	if sm.startupDeadline > 0 {
+		sm.startupScrape()
+		// Hosts not scraped before the deadline don't hold up readiness.
+		atomic.StoreInt64(&sm.unscraped, 0)
+	}
+	// Start scraping hosts. With a scrape budget, spread the first scrapes
+	// to stay under it from the start.
+	var stagger time.Duration
+	if sm.scrapeBudget > 0 {
+		stagger = time.Duration(float64(time.Second) / sm.scrapeBudget)
+	}
+	hosts := make([]*Host, 0, len(sm.hosts))
+	for _, host := range sm.hosts {
+		hosts = append(hosts, host)
+	}
+	sm.mutex.Lock()
+	sm.started = true
+	sm.mutex.Unlock()
+	sm.scheduler.Schedule(sm.ctx, hosts, sm.scrapeScheduled, sm.scrapeInterval, stagger)
+	if sm.targetDNS != "" {
+		go sm.resolveTargets()
+	}
+}
+
+// setDefaultPorts sets the port of the hosts without a port of their own to
+// the scrape port of the pool.
+func (sm *SessionManager) setDefaultPorts() {
+	for _, host := range sm.hosts {
+		// The port of the host takes precedence over the port of the pool.
+		if host.port != 0 {
+			continue
+		}
+		host.port = sm.defaultPort()
+		if sm.scrapePort == 0 {
+			log.Warningf("No scrape port for host %s. Using the default port %d.", host.ip, host.port)
+		}
+	}
+}
+
+// Stop stops scraping the hosts, e.g. on shutdown or reload.
+func (sm *SessionManager) Stop() {
+	sm.cancel()
+	sm.client.CloseIdleConnections()
+	if sm.webhook != nil {
+		sm.webhook.stop()
+	}
+}
+
+// reconcile carries over the scrape state of the hosts of the previous pool
+// to the hosts of sm, e.g. on reload. Hosts not in the previous pool start
+// out unscraped. Must be called before Start.
+func (sm *SessionManager) reconcile(previous *SessionManager) {
+	previous.mutex.RLock()
+	defer previous.mutex.RUnlock()
+	kept := 0
+	for addr, host := range sm.hosts {
+		old, ok := previous.hosts[addr]
+		if !ok {
+			continue
+		}
+		kept++
+		host.base = old.base
+		host.estimate = old.estimate
+		host.updated = old.updated
+		host.decayed = old.decayed
+		// The old manager may still scrape, so the ring buffer is copied.
+		host.window = append([]float64(nil), old.window...)
+		host.windowNext = old.windowNext
+		host.counter = old.counter
+		host.counterTime = old.counterTime
+		host.healthy = old.healthy
+		host.capacity = old.capacity
+		host.draining = old.draining
+		host.scheduled = old.scheduled
+		if _, ok := previous.active[addr]; ok {
+			sm.active[addr] = host
+		}
+	}
+	log.Infof("Reconciled pool. Kept %d hosts, added %d, removed %d.",
+		kept, len(sm.hosts)-kept, len(previous.hosts)-kept)
+}
+
+// Drain leaves the host out of answers until it is resumed. The host is
+// still scraped, to observe its sessions draining.
+func (sm *SessionManager) Drain(addr netip.Addr) error {
+	return sm.setDraining(addr, true)
+}
+
+// Resume includes a drained host in answers again.
+func (sm *SessionManager) Resume(addr netip.Addr) error {
+	return sm.setDraining(addr, false)
+}
+
+func (sm *SessionManager) setDraining(addr netip.Addr, draining bool) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	host, ok := sm.hosts[addr]
+	if !ok {
+		return fmt.Errorf("unknown host %s", addr)
+	}
+	if host.draining != draining {
+		log.Infof("Set draining of %v to %v.", addr, draining)
+		host.draining = draining
+		// The cached order may hold the drained host.
+		sm.order = nil
+	}
+	return nil
+}
+
+// Ready returns true once all hosts have been scraped since Start. With a
+// ready quorum, it returns true once as many hosts are active instead.
+func (sm *SessionManager) Ready() bool {
+	if sm.readyQuorum > 0 {
+		return uint(sm.activeCount()) >= sm.readyQuorum
+	}
+	return atomic.LoadInt64(&sm.unscraped) <= 0
+}
+
+// interfacePrefixes returns the subnets of the local interfaces.
+func interfacePrefixes() []netip.Prefix {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Errorf("Failed to get interface addresses: %v", err)
+		return nil
+	}
+	prefixes := []netip.Prefix{}
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr.String())
+		if err != nil {
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// markLocal marks the hosts in one of the local prefixes.
+func (sm *SessionManager) markLocal() {
+	for _, host := range sm.hosts {
+		host.local = sm.isLocal(host.ip)
+	}
+}
+
+// isLocal returns whether addr is in one of the local prefixes. Hosts added
+// after Start are marked as they are added.
+func (sm *SessionManager) isLocal(addr netip.Addr) bool {
+	for _, prefix := range sm.localPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// startupScrape scrapes all hosts once, with at most startupParallelism
+// concurrent scrapes. Hosts not scraped before the startup deadline start
+// out inactive. Stop aborts the startup scrape.
+func (sm *SessionManager) startupScrape() {
+	ctx, cancel := context.WithTimeout(sm.ctx, sm.startupDeadline)
+	defer cancel()
+	workers := make(chan struct{}, sm.startupParallelism)
+	var wg sync.WaitGroup
 	for _, host := range sm.hosts {
-		// Set defaults.
-		host.port = sm.scrapePort
-		// Start scraping hosts.
-		go sm.ScrapeLoop(host)
+		wg.Add(1)
+		go func(host *Host) {
+			defer wg.Done()
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			sm.scrapeContext(ctx, host)
+			<-workers
+		}(host)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		log.Warningf("Startup scrape did not complete within %v.", sm.startupDeadline)
+	}
+	for _, host := range sm.hosts {
+		sm.updateActive(host)
 	}
 }
 
@@ -152,49 +1430,603 @@ func (s byEstimated) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 func (s byEstimated) Less(i, j int) bool {
-	return s[i].estimate < s[j].estimate
+	if s[i].estimate != s[j].estimate {
+		return s[i].estimate < s[j].estimate
+	}
+	// Break ties in favor of local hosts.
+	return s[i].local && !s[j].local
 }
 
+// GetIPs returns the ips of the hosts of both address families.
 func (sm *SessionManager) GetIPs() []net.IP {
-	active := []*Host{}
+	return sm.GetFamilyIPs(0)
+}
+
+// GetFamilyIPs returns the ips of the hosts answering qtype, A or AAAA. Zero
+// returns both address families. Only the estimate of the first host of the
+// family is incremented.
+func (sm *SessionManager) GetFamilyIPs(qtype uint16) []net.IP {
+	// Answers update the estimates, so they take the write lock.
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if sm.inMaintenance() {
+		return sm.shuffledIPs(qtype)
+	}
+	sm.decay()
+	if sm.resortEpsilon <= 0 || sm.selection == selectionRotate || sm.distribution == distributionWeighted {
+		return sm.orderedIPs(sm.activeHosts(qtype), qtype)
+	}
+	if !sm.degraded && sm.orderCurrent(qtype) {
+		// The tier shuffle and sampling work on a copy, so the cached
+		// order stays as sorted.
+		hosts := append([]*Host(nil), sm.order[qtype]...)
+		sm.shuffleFirstTier(hosts)
+		return sm.least(hosts)
+	}
+	active := sm.activeHosts(qtype)
+	ips := sm.orderedIPs(active, qtype)
+	delete(sm.order, qtype)
+	if !sm.degraded && len(active) > 0 {
+		for _, host := range active {
+			host.sortedEstimate = host.estimate
+		}
+		if sm.order == nil {
+			sm.order = make(map[uint16][]*Host)
+		}
+		sm.order[qtype] = active
+	}
+	return ips
+}
+
+// GetClientIPs is like GetFamilyIPs, but answers depend on the subnet of
+// client. Only the subset of active hosts assigned to the subnet is
+// returned, if configured, and with rendezvous selection the hosts are
+// ordered by the preference of the subnet.
+func (sm *SessionManager) GetClientIPs(client netip.Addr, qtype uint16) []net.IP {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if sm.inMaintenance() {
+		return sm.shuffledIPs(qtype)
+	}
+	sm.decay()
+	active := sm.activeHosts(qtype)
+	if sm.subsetSize > 0 {
+		active = sm.subset(active, client)
+	}
+	if sm.selection == selectionRendezvous && !sm.degraded && len(active) > 0 {
+		return sm.answer(sm.rendezvous(active, client))
+	}
+	return sm.orderedIPs(active, qtype)
+}
+
+// inMaintenance returns true during the maintenance window.
+func (sm *SessionManager) inMaintenance() bool {
+	return sm.maintenance != nil && sm.maintenance.contains(sm.now())
+}
+
+// inFamily returns true if ip answers qtype, A or AAAA. Zero matches both
+// address families.
+func inFamily(ip netip.Addr, qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA:
+		return ip.Is4() || ip.Is4In6()
+	case dns.TypeAAAA:
+		return ip.Is6() && !ip.Is4In6()
+	}
+	return true
+}
+
+// activeHosts returns the active hosts answering qtype, in no particular
+// order. If fewer hosts than the active floor are active, the most recently
+// seen inactive hosts are added.
+func (sm *SessionManager) activeHosts(qtype uint16) []*Host {
+	active := make([]*Host, 0, len(sm.active))
 	for _, host := range sm.active {
-		active = append(active, host)
+		if !host.draining && inFamily(host.ip, qtype) {
+			active = append(active, host)
+		}
 	}
-	if len(active) == 0 {
-		log.Infof("No active hosts. Return all known ips, shuffled.")
-		ips := []net.IP{}
-		for ip, _ := range sm.hosts {
-			ips = append(ips, net.IP(ip.AsSlice()))
+	if uint(len(active)) >= sm.activeFloor {
+		return active
+	}
+	inactive := []*Host{}
+	for ip, host := range sm.hosts {
+		if _, ok := sm.active[ip]; !ok && !host.draining && inFamily(ip, qtype) && host.updated.After(time.Unix(0, 0)) {
+			inactive = append(inactive, host)
 		}
-		rand.Seed(time.Now().UnixNano())
-		rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
-		return ips
+	}
+	sort.Slice(inactive, func(i, j int) bool { return inactive[i].updated.After(inactive[j].updated) })
+	missing := int(sm.activeFloor) - len(active)
+	if missing > len(inactive) {
+		missing = len(inactive)
+	}
+	return append(active, inactive[:missing]...)
+}
 
+// orderedIPs returns the ips of the active hosts, ordered by estimated
+// number of connections. The estimate of the first host is incremented.
+// Without active hosts, the fallback answer is returned.
+func (sm *SessionManager) orderedIPs(active []*Host, qtype uint16) []net.IP {
+	if sm.degraded {
+		return sm.shuffledIPs(qtype)
+	}
+	if len(active) == 0 {
+		return sm.fallbackIPs(qtype)
+	}
+	if sm.selection == selectionRotate {
+		return sm.answer(sm.rotate(active))
 	}
 	// Sort active hosts by estimated number of connections.
-	ips := []net.IP{}
 	sort.Sort(byEstimated(active))
-	for _, host := range active {
-		ips = append(ips, net.IP(host.ip.AsSlice()))
+	if sm.distribution == distributionWeighted {
+		sm.shuffleByLoad(active)
+	} else {
+		sm.shuffleFirstTier(active)
+	}
+	return sm.least(active)
+}
+
+// fallbackIPs returns the ips answering qtype without active hosts: all
+// known ips shuffled, none, or the last known active hosts ordered by their
+// stale estimates. Without last known active hosts, e.g. before any host was
+// active, all known ips are returned.
+func (sm *SessionManager) fallbackIPs(qtype uint16) []net.IP {
+	switch sm.fallback {
+	case fallbackNone:
+		return nil
+	case fallbackLastKnown:
+		hosts := []*Host{}
+		for _, host := range sm.lastActive {
+			if !host.draining && inFamily(host.ip, qtype) {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) > 0 {
+			log.Infof("No active hosts. Return the %d last known active hosts.", len(hosts))
+			sort.Sort(byEstimated(hosts))
+			return sm.answer(hosts)
+		}
+	}
+	ips := sm.shuffledIPs(qtype)
+	if len(ips) > 0 {
+		log.Infof("No active hosts. Return all known ips, shuffled.")
 	}
-	// Increment estimated value for first host.
-	active[0].estimate++
 	return ips
 }
 
-// TODO(leffler): Used for debugging. Remove.
-func (sm *SessionManager) PrintState() {
-	log.Infof("Current active state:")
+// least returns the ips of the hosts sorted by load, with the head rotated
+// and the tail explored if configured.
+func (sm *SessionManager) least(sorted []*Host) []net.IP {
+	return sm.answer(sm.explore(sm.rotateHead(sorted)))
+}
+
+// explore returns the first host, followed by exploreCount random other
+// hosts. The sorted hosts are not modified.
+func (sm *SessionManager) explore(sorted []*Host) []*Host {
+	if sm.exploreCount == 0 || len(sorted) < 2 {
+		return sorted
+	}
+	others := append([]*Host(nil), sorted[1:]...)
+	sm.rng.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	if uint(len(others)) > sm.exploreCount {
+		others = others[:sm.exploreCount]
+	}
+	return append([]*Host{sorted[0]}, others...)
+}
+
+// rotateHead returns the sorted hosts with the headRotation least-loaded
+// hosts rotated by one more host on every query. The sorted hosts are not
+// modified.
+func (sm *SessionManager) rotateHead(sorted []*Host) []*Host {
+	k := int(sm.headRotation)
+	if k > len(sorted) {
+		k = len(sorted)
+	}
+	if k < 2 {
+		return sorted
+	}
+	offset := int(atomic.AddUint64(&sm.headRotations, 1) % uint64(k))
+	hosts := make([]*Host, 0, len(sorted))
+	hosts = append(hosts, sorted[offset:k]...)
+	hosts = append(hosts, sorted[:offset]...)
+	return append(hosts, sorted[k:]...)
+}
+
+// rotate orders hosts by ip, rotated by one more host on every query.
+// Estimates are ignored.
+func (sm *SessionManager) rotate(hosts []*Host) []*Host {
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].ip.Less(hosts[j].ip) })
+	offset := int(atomic.AddUint64(&sm.rotation, 1) % uint64(len(hosts)))
+	return append(hosts[offset:], hosts[:offset]...)
+}
+
+// answer returns the ips of the sorted hosts, sampled if configured. The
+// estimate of the first host is incremented.
+func (sm *SessionManager) answer(sorted []*Host) []net.IP {
+	if sm.sampleSize > 0 {
+		sorted = sm.sample(sorted)
+	}
+	var ips []net.IP
+	if sm.repeatMax > 0 {
+		// The hosts are capped before repeating, so the answer holds
+		// the repeated hosts in proportion, not only the first host.
+		if sm.repeatHosts > 0 && uint(len(sorted)) > sm.repeatHosts {
+			sorted = sorted[:sm.repeatHosts]
+		}
+		ips = sm.repeat(sorted)
+	} else {
+		ips = make([]net.IP, 0, len(sorted))
+		for _, host := range sorted {
+			ips = append(ips, host.netIP)
+		}
+	}
+	sm.selected(sorted[0])
+	return ips
+}
+
+// repeat returns the ips of the sorted hosts, each repeated in proportion
+// to the inverse of its estimate, up to repeatMax ips in total. Clients
+// picking a random record then approximate least-connections. Every host
+// is answered at least once, unless the most loaded hosts don't fit.
+func (sm *SessionManager) repeat(sorted []*Host) []net.IP {
+	weights := make([]float64, len(sorted))
+	total := 0.0
+	for i, host := range sorted {
+		estimate := math.Max(float64(host.estimate), 0)
+		weights[i] = 1 / (1 + estimate)
+		total += weights[i]
+	}
+	ips := make([]net.IP, 0, sm.repeatMax)
+	for i, host := range sorted {
+		n := int(math.Floor(float64(sm.repeatMax) * weights[i] / total))
+		if n < 1 {
+			n = 1
+		}
+		for ; n > 0 && len(ips) < int(sm.repeatMax); n-- {
+			ips = append(ips, host.netIP)
+		}
+	}
+	return ips
+}
+
+// selected increments the estimate of the first host of an answer, up to
+// the estimate ceiling.
+func (sm *SessionManager) selected(host *Host) {
+	if host.capacity > 0 {
+		// One more session, as a percentage of the capacity.
+		host.estimate += float32(100 / host.capacity)
+	} else {
+		host.estimate++
+	}
+	if ceiling, ok := sm.estimateCeiling(host); ok && host.estimate > ceiling {
+		host.estimate = ceiling
+	}
+	sessionSelectedCount.WithLabelValues(host.ip.String()).Inc()
+	sessionHostEstimate.WithLabelValues(host.ip.String()).Set(float64(host.estimate))
+}
+
+// decay decays the estimates of the active hosts towards their scraped
+// values, by the estimate half-life.
+func (sm *SessionManager) decay() {
+	if sm.estimateHalfLife <= 0 {
+		return
+	}
+	now := sm.now()
 	for _, host := range sm.active {
-		log.Infof(" - Host: %v estimate: %v", host.ip, host.estimate)
+		elapsed := now.Sub(host.decayed)
+		if elapsed <= 0 {
+			continue
+		}
+		remaining := math.Exp2(-elapsed.Seconds() / sm.estimateHalfLife.Seconds())
+		host.estimate = host.base + (host.estimate-host.base)*float32(remaining)
+		host.decayed = now
+		sessionHostEstimate.WithLabelValues(host.ip.String()).Set(float64(host.estimate))
 	}
 }
 
-// TODO(leffler): Used for debugging. Remove.
+// estimateCeiling returns the highest estimate of the host until it is
+// scraped again. Returns false if there is no ceiling.
+func (sm *SessionManager) estimateCeiling(host *Host) (float32, bool) {
+	ceiling := float32(math.Inf(1))
+	if sm.estimateFactor > 0 {
+		base := host.base
+		if base < 1 {
+			base = 1
+		}
+		ceiling = base * sm.estimateFactor
+	}
+	if sm.estimateMax > 0 && sm.estimateMax < ceiling {
+		ceiling = sm.estimateMax
+	}
+	return ceiling, !math.IsInf(float64(ceiling), 1)
+}
+
+// orderCurrent returns true if no estimate changed by more than the resort
+// epsilon since the hosts answering qtype were last sorted.
+func (sm *SessionManager) orderCurrent(qtype uint16) bool {
+	if len(sm.order[qtype]) == 0 {
+		return false
+	}
+	for _, host := range sm.order[qtype] {
+		if math.Abs(float64(host.estimate-host.sortedEstimate)) > float64(sm.resortEpsilon) {
+			return false
+		}
+	}
+	return true
+}
+
+// subset returns the subsetSize hosts assigned to the subnet of client by
+// rendezvous hashing. The subset is stable as long as the active set is,
+// and only changes by the hosts leaving or joining the active set.
+func (sm *SessionManager) subset(hosts []*Host, client netip.Addr) []*Host {
+	if uint(len(hosts)) <= sm.subsetSize {
+		return hosts
+	}
+	key := sm.subnetKey(client)
+	scores := make(map[*Host]uint64, len(hosts))
+	for _, host := range hosts {
+		h := fnv.New64a()
+		h.Write(key)
+		h.Write(host.ip.AsSlice())
+		scores[host] = h.Sum64()
+	}
+	sort.Slice(hosts, func(i, j int) bool { return scores[hosts[i]] > scores[hosts[j]] })
+	return hosts[:sm.subsetSize]
+}
+
+// rendezvous orders hosts by their rendezvous hash with the subnet of
+// client, divided by one plus their estimate. Each subnet keeps a stable
+// preference for hosts, while loaded hosts move down for every subnet.
+func (sm *SessionManager) rendezvous(hosts []*Host, client netip.Addr) []*Host {
+	key := sm.subnetKey(client)
+	scores := make(map[*Host]float64, len(hosts))
+	for _, host := range hosts {
+		h := fnv.New64a()
+		h.Write(key)
+		h.Write(host.ip.AsSlice())
+		// The hash as a fraction in (0, 1].
+		hash := float64(h.Sum64()>>11+1) / (1 << 53)
+		scores[host] = hash / (1 + math.Max(float64(host.estimate), 0))
+	}
+	sort.Slice(hosts, func(i, j int) bool { return scores[hosts[i]] > scores[hosts[j]] })
+	return hosts
+}
+
+// subnetKey returns the subnet of client, as the key of rendezvous hashes.
+func (sm *SessionManager) subnetKey(client netip.Addr) []byte {
+	bits := sm.subsetBits
+	if bits > client.BitLen() {
+		bits = client.BitLen()
+	}
+	subnet, _ := client.Prefix(bits)
+	key, _ := subnet.MarshalBinary()
+	return key
+}
+
+// fresh returns true if the host of ip was scraped within the scrape interval.
+func (sm *SessionManager) fresh(ip net.IP) bool {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	host, ok := sm.hostOf(ip)
+	return ok && sm.now().Sub(host.updated) < sm.scrapeInterval()
+}
+
+// sampled counts a successful scrape of the host. Must be called with the
+// write lock held.
+func (sm *SessionManager) sampled(host *Host) {
+	host.samples++
+	sm.lastScrapeSuccess = sm.now()
+}
+
+// samplesOf returns the number of samples scraped from the host.
+func (sm *SessionManager) samplesOf(host *Host) uint64 {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return host.samples
+}
+
+// estimateOf returns the estimate of the host of ip.
+func (sm *SessionManager) estimateOf(ip net.IP) (float32, bool) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	host, ok := sm.hostOf(ip)
+	if !ok {
+		return 0, false
+	}
+	return host.estimate, true
+}
+
+// activeCount returns the number of active hosts.
+func (sm *SessionManager) activeCount() int {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return len(sm.active)
+}
+
+// hostOf returns the host of ip.
+func (sm *SessionManager) hostOf(ip net.IP) (*Host, bool) {
+	addr, _ := netip.AddrFromSlice(ip)
+	host, ok := sm.hosts[addr.Unmap()]
+	return host, ok
+}
+
+// Rerank orders ips by estimated number of connections. Ips of active hosts
+// come first, followed by the other ips in their original order. The
+// estimate of the first host is incremented.
+func (sm *SessionManager) Rerank(ips []net.IP) []net.IP {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.decay()
+	known := []*Host{}
+	rest := []net.IP{}
+	for _, ip := range ips {
+		addr, _ := netip.AddrFromSlice(ip)
+		if host, ok := sm.active[addr.Unmap()]; ok && !host.draining {
+			known = append(known, host)
+		} else {
+			rest = append(rest, ip)
+		}
+	}
+	sort.Stable(byEstimated(known))
+	reranked := []net.IP{}
+	for _, host := range known {
+		reranked = append(reranked, host.netIP)
+	}
+	if len(known) > 0 {
+		sm.selected(known[0])
+	}
+	return append(reranked, rest...)
+}
+
+// ShuffledIPs returns all known ips answering qtype, shuffled, except those
+// of draining hosts. Unlike GetIPs, it doesn't update the estimates.
+func (sm *SessionManager) ShuffledIPs(qtype uint16) []net.IP {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.shuffledIPs(qtype)
+}
+
+// shuffledIPs returns all known ips answering qtype, shuffled, except those
+// of draining hosts. Must hold the lock.
+func (sm *SessionManager) shuffledIPs(qtype uint16) []net.IP {
+	addrs := []netip.Addr{}
+	for ip, host := range sm.hosts {
+		if !host.draining && inFamily(ip, qtype) {
+			addrs = append(addrs, ip)
+		}
+	}
+	// Sorted first, so the shuffle only depends on the seed.
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	sm.rng.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = net.IP(addr.AsSlice())
+	}
+	return ips
+}
+
+// lockedRand is a random number generator safe for concurrent use. Unlike
+// the global source, it can be seeded for reproducible tests.
+type lockedRand struct {
+	mutex sync.Mutex
+	rng   *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rng.Shuffle(n, swap)
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rng.Float64()
+}
+
+// shuffleByLoad shuffles hosts, weighted by the inverse of one plus their
+// estimate. Each host comes first with a probability in proportion to its
+// weight.
+func (sm *SessionManager) shuffleByLoad(hosts []*Host) {
+	keys := make(map[*Host]float64, len(hosts))
+	for _, host := range hosts {
+		// The key u^(1/weight) of weighted random sampling, in log scale.
+		u := 1 - sm.rng.Float64()
+		keys[host] = math.Log(u) * (1 + math.Max(float64(host.estimate), 0))
+	}
+	sort.Slice(hosts, func(i, j int) bool { return keys[hosts[i]] > keys[hosts[j]] })
+}
+
+// shuffleFirstTier randomly shuffles the hosts in the least-loaded tier.
+// Hosts must be sorted by estimate.
+func (sm *SessionManager) shuffleFirstTier(hosts []*Host) {
+	if len(hosts) < 2 {
+		return
+	}
+	if sm.generationJitter {
+		sm.jitterFirstTier(hosts)
+		return
+	}
+	if sm.tierWidth <= 0 {
+		return
+	}
+	n := sm.firstTier(hosts)
+	sm.rng.Shuffle(n, func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
+}
+
+// jitterFirstTier orders the least-loaded tier by a hash of the host and the
+// scrape generation. The order only changes with the generation. Hosts must
+// be sorted by estimate.
+func (sm *SessionManager) jitterFirstTier(hosts []*Host) {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sm.generation())
+	n := sm.firstTier(hosts)
+	scores := make(map[*Host]uint64, n)
+	for _, host := range hosts[:n] {
+		h := fnv.New64a()
+		h.Write(key)
+		h.Write(host.ip.AsSlice())
+		scores[host] = h.Sum64()
+	}
+	tier := hosts[:n]
+	sort.Slice(tier, func(i, j int) bool { return scores[tier[i]] > scores[tier[j]] })
+}
+
+// generation returns the scrape generation.
+func (sm *SessionManager) generation() uint64 {
+	n := uint64(len(sm.hosts))
+	if n == 0 {
+		n = 1
+	}
+	return atomic.LoadUint64(&sm.scrapes) / n
+}
+
+// firstTier returns the number of hosts in the least-loaded tier. Without a
+// tier width, the tier holds the hosts with the lowest estimate. Hosts must
+// be sorted by estimate.
+func (sm *SessionManager) firstTier(hosts []*Host) int {
+	tier := func(host *Host) float64 {
+		if sm.tierWidth <= 0 {
+			return float64(host.estimate)
+		}
+		return math.Floor(float64(host.estimate / sm.tierWidth))
+	}
+	n := 1
+	for n < len(hosts) && tier(hosts[n]) == tier(hosts[0]) {
+		n++
+	}
+	return n
+}
+
+// sample returns sampleSize hosts randomly picked from the least-loaded
+// tier. If the tier is smaller, the next hosts by estimate are added. Hosts
+// must be sorted by estimate.
+func (sm *SessionManager) sample(hosts []*Host) []*Host {
+	if uint(len(hosts)) <= sm.sampleSize {
+		return hosts
+	}
+	n := sm.firstTier(hosts)
+	sm.rng.Shuffle(n, func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
+	return hosts[:sm.sampleSize]
+}
+
+// ListIPs returns the ips of all hosts of the pool, sorted. The state of
+// the hosts is served by the admin endpoint.
 func (sm *SessionManager) ListIPs() []string {
-	ips := []string{}
-	for ip, _ := range sm.hosts {
-		ips = append(ips, ip.String())
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	addrs := make([]netip.Addr, 0, len(sm.hosts))
+	for ip := range sm.hosts {
+		addrs = append(addrs, ip)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	ips := make([]string, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.String()
 	}
 	return ips
 }
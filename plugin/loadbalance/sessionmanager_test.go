@@ -0,0 +1,1925 @@
+package loadbalance
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io"
+	golog "log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTestTarget starts a metrics endpoint listening on addr, serving body.
+// It returns the host address and port to scrape.
+func newTestTarget(t *testing.T, addr string, body string) (netip.Addr, uint16) {
+	t.Helper()
+	return newTestTargetHandler(t, addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+}
+
+// newTestTargetHandler starts a metrics endpoint listening on addr, served by handler.
+func newTestTargetHandler(t *testing.T, addr string, handler http.Handler) (netip.Addr, uint16) {
+	t.Helper()
+	l, err := net.Listen("tcp", addr+":0")
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = l
+	server.Start()
+	t.Cleanup(server.Close)
+	ap := netip.MustParseAddrPort(l.Addr().String())
+	return ap.Addr(), ap.Port()
+}
+
+// testMetrics returns a metrics page with the connections and up gauges.
+func testMetrics(connections, up float64) string {
+	return fmt.Sprintf("# TYPE connections gauge\nconnections %v\n# TYPE up gauge\nup %v\n",
+		connections, up)
+}
+
+// addTestHost adds a host to the session manager, scraped on the given port.
+func addTestHost(sm *SessionManager, ip netip.Addr, port uint16) *Host {
+	sm.Add(ip)
+	host := sm.hosts[ip]
+	host.port = port
+	return host
+}
+
+// addActiveHost adds a recently scraped host with the given estimate to the active list.
+func addActiveHost(sm *SessionManager, ip string, estimate float32) *Host {
+	addr := netip.MustParseAddr(ip)
+	sm.Add(addr)
+	host := sm.hosts[addr]
+	host.Update(estimate)
+	host.healthy = true
+	sm.active[addr] = host
+	return host
+}
+
+func TestScrapeHealthMetric(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.healthMetric = "up"
+
+	ip, port := newTestTarget(t, "127.0.0.1", testMetrics(1, 1))
+	healthy := addTestHost(sm, ip, port)
+	ip, port = newTestTarget(t, "127.0.0.2", testMetrics(0, 0))
+	unhealthy := addTestHost(sm, ip, port)
+
+	for _, host := range []*Host{healthy, unhealthy} {
+		sm.Scrape(host)
+		sm.updateActive(host)
+	}
+
+	if unhealthy.estimate != 0 || unhealthy.updated.Unix() == 0 {
+		t.Errorf("Expected unhealthy host to be scraped, got estimate %v updated %v",
+			unhealthy.estimate, unhealthy.updated)
+	}
+	if _, ok := sm.active[unhealthy.ip]; ok {
+		t.Errorf("Expected unhealthy host %v to be excluded from active list", unhealthy.ip)
+	}
+	if _, ok := sm.active[healthy.ip]; !ok {
+		t.Errorf("Expected healthy host %v in active list", healthy.ip)
+	}
+	ips := sm.GetIPs()
+	if len(ips) != 1 || !ips[0].Equal(net.IP(healthy.ip.AsSlice())) {
+		t.Errorf("Expected only %v, got %v", healthy.ip, ips)
+	}
+}
+
+func TestGetIPsTiers(t *testing.T) {
+	sm := NewSessionManager()
+	sm.tierWidth = 100
+	addActiveHost(sm, "10.0.0.1", 1)
+	addActiveHost(sm, "10.0.0.2", 2)
+	addActiveHost(sm, "10.0.0.3", 3)
+	addActiveHost(sm, "10.0.0.4", 160)
+	addActiveHost(sm, "10.0.0.5", 150)
+
+	firstTier := map[string]bool{"10.0.0.1": true, "10.0.0.2": true, "10.0.0.3": true}
+	heads := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		ips := sm.GetIPs()
+		if len(ips) != 5 {
+			t.Fatalf("Expected 5 ips, got %v", ips)
+		}
+		for _, ip := range ips[:3] {
+			if !firstTier[ip.String()] {
+				t.Errorf("Query %d: Expected %v in the first tier, got %v", i, ip, ips)
+			}
+		}
+		if ips[3].String() != "10.0.0.5" || ips[4].String() != "10.0.0.4" {
+			t.Errorf("Query %d: Expected second tier ordered by estimate, got %v", i, ips[3:])
+		}
+		heads[ips[0].String()] = true
+	}
+	if len(heads) < 2 {
+		t.Errorf("Expected the first tier to be shuffled, got heads %v", heads)
+	}
+}
+
+func TestScrapeTotalFailure(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.scrapeFailureWindow = 10 * time.Second
+	host := addActiveHost(sm, "127.0.0.1", 5)
+	other := addActiveHost(sm, "127.0.0.2", 1)
+
+	// Scrape a closed port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.port = netip.MustParseAddrPort(l.Addr().String()).Port()
+	l.Close()
+	sm.lastScrapeSuccess = time.Now().Add(-2 * sm.scrapeFailureWindow)
+	sm.Scrape(host)
+	sm.checkDegraded()
+	if !sm.degraded {
+		t.Fatalf("Expected degraded mode after total scrape failure")
+	}
+	if ips := sm.GetIPs(); len(ips) != 2 {
+		t.Errorf("Expected all ips in degraded mode, got %v", ips)
+	}
+	if host.estimate != 5 || other.estimate != 1 {
+		t.Errorf("Expected estimates to be left untouched in degraded mode, got %v and %v",
+			host.estimate, other.estimate)
+	}
+
+	// Recover.
+	_, host.port = newTestTarget(t, "127.0.0.1", testMetrics(0, 1))
+	sm.Scrape(host)
+	sm.checkDegraded()
+	if sm.degraded {
+		t.Fatalf("Expected degraded mode to end after a successful scrape")
+	}
+	ips := sm.GetIPs()
+	if len(ips) != 2 || ips[0].String() != "127.0.0.1" {
+		t.Errorf("Expected 127.0.0.1 first after recovery, got %v", ips)
+	}
+}
+
+func TestDegradedSkipsDraining(t *testing.T) {
+	sm := NewSessionManager()
+	addActiveHost(sm, "10.0.0.1", 1)
+	addActiveHost(sm, "10.0.0.2", 2)
+	if err := sm.Drain(netip.MustParseAddr("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	sm.degraded = true
+	for i := 0; i < 10; i++ {
+		if ips := sm.GetIPs(); len(ips) != 1 || ips[0].String() != "10.0.0.2" {
+			t.Fatalf("Expected only 10.0.0.2 in degraded mode, got %v", ips)
+		}
+	}
+}
+
+func TestGetIPsSelectedCount(t *testing.T) {
+	sm := NewSessionManager()
+	addActiveHost(sm, "10.0.1.1", 0)
+	addActiveHost(sm, "10.0.1.2", 0.5)
+	counter := func(ip string) float64 {
+		return testutil.ToFloat64(sessionSelectedCount.WithLabelValues(ip))
+	}
+	before1, before2 := counter("10.0.1.1"), counter("10.0.1.2")
+
+	// 10.0.1.1 leads until its estimate passes 10.0.1.2, after which they alternate.
+	for i := 0; i < 4; i++ {
+		sm.GetIPs()
+	}
+	if got := counter("10.0.1.1") - before1; got != 2 {
+		t.Errorf("Expected 10.0.1.1 selected 2 times, got %v", got)
+	}
+	if got := counter("10.0.1.2") - before2; got != 2 {
+		t.Errorf("Expected 10.0.1.2 selected 2 times, got %v", got)
+	}
+}
+
+func TestScrapeHeaders(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.scrapeHeaders.Set("Authorization", "Bearer token")
+	sm.scrapeHeaders.Add("X-Route", "a")
+
+	var got http.Header
+	ip, port := newTestTargetHandler(t, "127.0.0.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		fmt.Fprint(w, testMetrics(3, 1))
+	}))
+	host := addTestHost(sm, ip, port)
+	sm.Scrape(host)
+
+	if got.Get("Authorization") != "Bearer token" || got.Get("X-Route") != "a" {
+		t.Errorf("Expected custom headers on scrape request, got %v", got)
+	}
+	if host.estimate != 3 {
+		t.Errorf("Expected estimate 3, got %v", host.estimate)
+	}
+}
+
+func TestScrapeJSON(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeFormat = scrapeFormatJSON
+	sm.scrapeJSONPath = "stats.connections.active"
+
+	tests := []struct {
+		body     string
+		updated  bool
+		expected float32
+	}{
+		{`{"stats": {"connections": {"active": 42, "idle": 3}}}`, true, 42},
+		{`{"stats": {"connections": {"idle": 3}}}`, false, 0},
+		{`{"stats": {"connections": {"active": "many"}}}`, false, 0},
+		{`{"stats": [1, 2]}`, false, 0},
+		{`not json`, false, 0},
+	}
+	for i, test := range tests {
+		ip, port := newTestTarget(t, "127.0.0.1", test.body)
+		host := &Host{ip: ip, port: port, updated: time.Unix(0, 0)}
+		sm.Scrape(host)
+		if updated := host.updated.Unix() != 0; updated != test.updated {
+			t.Errorf("Test %d: Expected updated %v, got %v", i, test.updated, updated)
+		}
+		if host.estimate != test.expected {
+			t.Errorf("Test %d: Expected estimate %v, got %v", i, test.expected, host.estimate)
+		}
+	}
+}
+
+func TestStartupScrapeDeadline(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.startupParallelism = 2
+	sm.startupDeadline = 500 * time.Millisecond
+
+	fast := []*Host{}
+	for _, addr := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		ip, port := newTestTarget(t, addr, testMetrics(1, 1))
+		fast = append(fast, addTestHost(sm, ip, port))
+	}
+	ip, port := newTestTargetHandler(t, "127.0.0.4", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	slow := addTestHost(sm, ip, port)
+
+	start := time.Now()
+	sm.startupScrape()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected startup scrape to complete within the deadline, took %v", elapsed)
+	}
+	for _, host := range fast {
+		if _, ok := sm.active[host.ip]; !ok {
+			t.Errorf("Expected fast host %v in active list", host.ip)
+		}
+	}
+	if _, ok := sm.active[slow.ip]; ok {
+		t.Errorf("Expected slow host %v not in active list", slow.ip)
+	}
+}
+
+func TestScrapeCounterMaxRate(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "sessions_total"
+	sm.maxRate = 5
+	host := addTestHost(sm, netip.MustParseAddr("10.0.0.1"), 0)
+	now := time.Now()
+	sm.now = func() time.Time { return now }
+	scrape := func(value float64) {
+		t.Helper()
+		now = now.Add(10 * time.Second)
+		body := fmt.Sprintf("# TYPE sessions_total counter\nsessions_total %v\n", value)
+		if err := sm.scrapePrometheus(host, strings.NewReader(body)); err != nil {
+			t.Fatalf("Failed to scrape: %v", err)
+		}
+	}
+
+	scrape(100)
+	scrape(140)
+	if host.estimate != 4 {
+		t.Fatalf("Expected rate 4/s, got %v", host.estimate)
+	}
+
+	// 900 in 10 seconds is above 5/s.
+	scrape(1040)
+	if host.estimate != 4 {
+		t.Errorf("Expected the implausible rate to keep estimate 4, got %v", host.estimate)
+	}
+
+	// The jump is the baseline of the next rate.
+	scrape(1060)
+	if host.estimate != 2 {
+		t.Errorf("Expected rate 2/s after the jump, got %v", host.estimate)
+	}
+
+	// The ceiling applies to counter rates, not gauges or percentages.
+	sm.update(host, 1000)
+	if host.estimate != 1000 {
+		t.Errorf("Expected gauge estimate 1000, got %v", host.estimate)
+	}
+}
+
+func TestReconcileCopiesWindow(t *testing.T) {
+	previous := NewSessionManager()
+	previous.percentile = 50
+	previous.percentileWindow = 3
+	old := addActiveHost(previous, "10.0.0.1", 0)
+	for _, value := range []float64{10, 20, 30} {
+		previous.update(old, value)
+	}
+	sm := NewSessionManager()
+	sm.Add(old.ip)
+	sm.reconcile(previous)
+
+	// A late scrape of the previous pool doesn't change the window of sm.
+	previous.update(old, 100)
+	if window := sm.hosts[old.ip].window; !slices.Equal(window, []float64{10, 20, 30}) {
+		t.Errorf("Expected window [10 20 30], got %v", window)
+	}
+}
+
+func TestUpdateMetricPercentile(t *testing.T) {
+	sm := NewSessionManager()
+	sm.percentile = 80
+	sm.percentileWindow = 5
+	host := &Host{ip: netip.MustParseAddr("10.0.0.1"), updated: time.Unix(0, 0)}
+
+	// A single spike is ignored once the window holds enough values, while
+	// the window slides past older values.
+	tests := []struct {
+		value    float64
+		expected float32
+	}{
+		{10, 10},
+		{20, 20},
+		{15, 20},
+		{100, 100},
+		{12, 20},
+		{14, 20},
+		{16, 16},
+		{18, 18},
+		{11, 16},
+		{13, 16},
+	}
+	for i, tc := range tests {
+		sm.update(host, tc.value)
+		if host.estimate != tc.expected {
+			t.Errorf("Scrape %d: expected estimate %v after %v, got %v", i, tc.expected, tc.value, host.estimate)
+		}
+	}
+}
+
+func TestScrapeCounterRate(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "sessions_total"
+	host := addTestHost(sm, netip.MustParseAddr("10.0.0.1"), 0)
+	now := time.Now()
+	sm.now = func() time.Time { return now }
+	scrape := func(value float64) {
+		t.Helper()
+		body := fmt.Sprintf("# TYPE sessions_total counter\nsessions_total %v\n", value)
+		if err := sm.scrapePrometheus(host, strings.NewReader(body)); err != nil {
+			t.Fatalf("Failed to scrape: %v", err)
+		}
+	}
+
+	// The first sample is only the baseline.
+	scrape(1000)
+	if host.updated != time.Unix(0, 0) {
+		t.Fatalf("Expected no update from the first counter sample, got estimate %v", host.estimate)
+	}
+
+	now = now.Add(10 * time.Second)
+	scrape(1050)
+	if host.estimate != 5 {
+		t.Errorf("Expected rate 5/s, got %v", host.estimate)
+	}
+
+	// A reset starts a new baseline, and keeps the previous estimate.
+	now = now.Add(10 * time.Second)
+	scrape(20)
+	if host.estimate != 5 {
+		t.Errorf("Expected estimate 5 after reset, got %v", host.estimate)
+	}
+	now = now.Add(10 * time.Second)
+	scrape(40)
+	if host.estimate != 2 {
+		t.Errorf("Expected rate 2/s after reset, got %v", host.estimate)
+	}
+}
+
+func TestScrapeCounterWarmUp(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "sessions_total"
+	var value int32 = 1000
+	ip, port := newTestTargetHandler(t, "127.0.0.11", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE sessions_total counter\nsessions_total %d\n", atomic.LoadInt32(&value))
+	}))
+	host := addTestHost(sm, ip, port)
+	now := time.Now()
+	sm.now = func() time.Time { return now }
+	failures := func() float64 {
+		return testutil.ToFloat64(sessionScrapeFailures.WithLabelValues(ip.String()))
+	}
+	before := failures()
+
+	// The first sample is the baseline of the rate, not a failure.
+	now = now.Add(time.Minute)
+	sm.Scrape(host)
+	sm.updateActive(host)
+	if got := failures() - before; got != 0 {
+		t.Errorf("Expected no scrape failure for the first counter sample, got %v", got)
+	}
+	if _, ok := sm.active[host.ip]; ok {
+		t.Errorf("Expected the host unscored after the first counter sample")
+	}
+	if !sm.lastScrapeSuccess.Equal(now) {
+		t.Errorf("Expected the first counter sample to count as a successful scrape")
+	}
+
+	now = now.Add(10 * time.Second)
+	atomic.StoreInt32(&value, 1050)
+	sm.Scrape(host)
+	sm.updateActive(host)
+	if _, ok := sm.active[host.ip]; !ok || host.estimate != 5 {
+		t.Errorf("Expected the host active with rate 5/s, got %v", host.estimate)
+	}
+	if got := failures() - before; got != 0 {
+		t.Errorf("Expected no scrape failures, got %v", got)
+	}
+}
+
+func TestScrapeCounterRateElapsed(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "sessions_total"
+	host := addTestHost(sm, netip.MustParseAddr("10.0.0.1"), 0)
+	now := time.Now()
+	sm.now = func() time.Time { return now }
+	scrape := func(body string) {
+		t.Helper()
+		if err := sm.scrapePrometheus(host, strings.NewReader(body)); err != nil {
+			t.Fatalf("Failed to scrape: %v", err)
+		}
+	}
+
+	// Scrapes 5s and 20s apart, instead of the 15s interval.
+	tests := []struct {
+		elapsed  time.Duration
+		value    float64
+		expected float32
+	}{
+		{0, 0, 0},
+		{5 * time.Second, 50, 10},
+		{20 * time.Second, 250, 10},
+		{time.Second, 254, 4},
+	}
+	for i, tc := range tests {
+		now = now.Add(tc.elapsed)
+		scrape(fmt.Sprintf("# TYPE sessions_total counter\nsessions_total %v\n", tc.value))
+		if i > 0 && host.estimate != tc.expected {
+			t.Errorf("Scrape %d: Expected rate %v/s, got %v", i, tc.expected, host.estimate)
+		}
+	}
+
+	// Exposed timestamps take precedence over the scrape time.
+	ms := now.UnixMilli()
+	scrape(fmt.Sprintf("# TYPE sessions_total counter\nsessions_total 254 %d\n", ms))
+	now = now.Add(time.Second)
+	scrape(fmt.Sprintf("# TYPE sessions_total counter\nsessions_total 304 %d\n", ms+10000))
+	if host.estimate != 5 {
+		t.Errorf("Expected rate 5/s between the exposed timestamps, got %v", host.estimate)
+	}
+}
+
+func TestScrapeMetricSuffix(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(io.Discard)
+
+	sm := NewSessionManager()
+	sm.scrapeMetric = "http_requests"
+	host := addTestHost(sm, netip.MustParseAddr("10.0.0.1"), 0)
+	now := time.Now()
+	sm.now = func() time.Time { return now }
+	scrape := func(value float64) error {
+		body := fmt.Sprintf("# TYPE http_requests_total counter\nhttp_requests_total %v\n", value)
+		return sm.scrapePrometheus(host, strings.NewReader(body))
+	}
+
+	if err := scrape(100); err == nil {
+		t.Fatalf("Expected http_requests not found without the suffix option")
+	}
+
+	sm.metricSuffix = true
+	for _, value := range []float64{100, 150, 200} {
+		if err := scrape(value); err != nil {
+			t.Fatalf("Failed to scrape http_requests_total: %v", err)
+		}
+		now = now.Add(10 * time.Second)
+	}
+	if host.estimate != 5 {
+		t.Errorf("Expected rate 5/s of http_requests_total, got %v", host.estimate)
+	}
+	if n := strings.Count(buf.String(), "Metric http_requests not found. Using http_requests_total."); n != 1 {
+		t.Errorf("Expected the matched variant logged once, got %q", buf.String())
+	}
+}
+
+func TestScrapeLabels(t *testing.T) {
+	body := `# TYPE tcp_connections gauge
+tcp_connections{port="53",state="established"} 12
+tcp_connections{port="53",state="time_wait"} 40
+tcp_connections{port="853",state="established"} 3
+`
+	tests := []struct {
+		labels   map[string]string
+		expected float32
+		err      string
+	}{
+		{nil, 12, ""},
+		{map[string]string{"state": "time_wait"}, 40, ""},
+		{map[string]string{"state": "established", "port": "853"}, 3, ""},
+		{map[string]string{"state": "established"}, 0, "more than one series"},
+		{map[string]string{"state": "closed"}, 0, "no series"},
+		{map[string]string{"zone": "a"}, 0, "no series"},
+	}
+	for _, tc := range tests {
+		sm := NewSessionManager()
+		sm.scrapeMetric = "tcp_connections"
+		sm.scrapeLabels = tc.labels
+		host := addTestHost(sm, netip.MustParseAddr("10.0.0.1"), 0)
+		err := sm.scrapePrometheus(host, strings.NewReader(body))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Labels %v: expected error containing %q, got %v", tc.labels, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Labels %v: unexpected error: %v", tc.labels, err)
+		} else if host.estimate != tc.expected {
+			t.Errorf("Labels %v: expected estimate %v, got %v", tc.labels, tc.expected, host.estimate)
+		}
+	}
+}
+
+func TestScrapeSummaryHistogram(t *testing.T) {
+	body := `# TYPE request_duration_seconds summary
+request_duration_seconds{quantile="0.5"} 0.02
+request_duration_seconds{quantile="0.99"} 0.25
+request_duration_seconds_sum 8
+request_duration_seconds_count 100
+# TYPE idle_duration_seconds summary
+idle_duration_seconds{quantile="0.99"} NaN
+idle_duration_seconds_sum 0
+idle_duration_seconds_count 0
+# TYPE response_seconds histogram
+response_seconds_bucket{le="0.1"} 60
+response_seconds_bucket{le="0.5"} 90
+response_seconds_bucket{le="+Inf"} 100
+response_seconds_sum 20
+response_seconds_count 100
+`
+	tests := []struct {
+		metric   string
+		quantile float64
+		bucket   float64
+		expected float32
+		err      string
+	}{
+		{"request_duration_seconds", 0, 0, 0.08, ""},
+		{"request_duration_seconds", 0.99, 0, 0.25, ""},
+		{"request_duration_seconds", 0.9, 0, 0, "has no quantile 0.9, only [0.5 0.99]"},
+		{"idle_duration_seconds", 0.99, 0, 0, "no value at quantile 0.99"},
+		{"idle_duration_seconds", 0, 0, 0, ""},
+		{"response_seconds", 0, 0, 0.2, ""},
+		{"response_seconds", 0, 0.1, 0.4, ""},
+		{"response_seconds", 0, 0.5, 0.1, ""},
+		{"response_seconds", 0, 0.25, 0, "has no bucket 0.25"},
+	}
+	for _, tc := range tests {
+		sm := NewSessionManager()
+		sm.scrapeMetric = tc.metric
+		sm.scrapeQuantile = tc.quantile
+		sm.scrapeBucket = tc.bucket
+		host := addTestHost(sm, netip.MustParseAddr("10.0.0.1"), 0)
+		err := sm.scrapePrometheus(host, strings.NewReader(body))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s quantile %v bucket %v: expected error containing %q, got %v", tc.metric, tc.quantile, tc.bucket, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s quantile %v bucket %v: unexpected error: %v", tc.metric, tc.quantile, tc.bucket, err)
+		} else if math.Abs(float64(host.estimate-tc.expected)) > 1e-6 {
+			t.Errorf("%s quantile %v bucket %v: expected estimate %v, got %v", tc.metric, tc.quantile, tc.bucket, tc.expected, host.estimate)
+		}
+	}
+}
+
+func TestGetIPsPreferLocal(t *testing.T) {
+	sm := NewSessionManager()
+	sm.preferLocal = true
+	sm.localPrefixes = []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")}
+	addActiveHost(sm, "10.0.0.1", 1)
+	addActiveHost(sm, "10.0.1.1", 1)
+	addActiveHost(sm, "10.0.0.2", 0)
+	sm.markLocal()
+
+	// The local host wins the tie, but not against a lower estimate.
+	ips := sm.GetIPs()
+	expected := []string{"10.0.0.2", "10.0.1.1", "10.0.0.1"}
+	for i, ip := range expected {
+		if ips[i].String() != ip {
+			t.Errorf("Expected %v, got %v", expected, ips)
+			break
+		}
+	}
+}
+
+func TestPreferLocalAddedAfterStart(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.preferLocal = true
+	sm.Start()
+	defer sm.Stop()
+	sm.mutex.Lock()
+	sm.localPrefixes = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/30")}
+	sm.mutex.Unlock()
+
+	sm.Add(netip.MustParseAddr("127.0.0.2"))
+	sm.SetTargets([]netip.Addr{
+		netip.MustParseAddr("127.0.0.2"),
+		netip.MustParseAddr("127.0.0.3"),
+		netip.MustParseAddr("127.0.0.9"),
+	})
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	for ip, local := range map[string]bool{"127.0.0.2": true, "127.0.0.3": true, "127.0.0.9": false} {
+		if host := sm.hosts[netip.MustParseAddr(ip)]; host.local != local {
+			t.Errorf("Expected host %s local %v, got %v", ip, local, host.local)
+		}
+	}
+}
+
+func TestScrapeSubnetLimit(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.subnetLimit = 2
+
+	var inflight, maxInflight int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, testMetrics(1, 1))
+	})
+	hosts := []*Host{}
+	for i := 1; i <= 6; i++ {
+		ip, port := newTestTargetHandler(t, fmt.Sprintf("127.0.0.%d", i), handler)
+		hosts = append(hosts, addTestHost(sm, ip, port))
+	}
+
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host *Host) {
+			defer wg.Done()
+			sm.Scrape(host)
+		}(host)
+	}
+	wg.Wait()
+
+	if maxInflight > 2 {
+		t.Errorf("Expected at most 2 concurrent scrapes in 127.0.0.0/24, got %d", maxInflight)
+	}
+	for _, host := range hosts {
+		if host.estimate != 1 {
+			t.Errorf("Expected host %v to be scraped, got estimate %v", host.ip, host.estimate)
+		}
+	}
+}
+
+func TestScrapeIntervalBudget(t *testing.T) {
+	sm := NewSessionManager()
+	if interval := sm.scrapeInterval(); interval != DefaultScrapeSeconds*time.Second {
+		t.Errorf("Expected default interval without a budget, got %v", interval)
+	}
+
+	sm.scrapeBudget = 10
+	tests := []struct {
+		hosts    int
+		interval time.Duration
+		timeout  uint
+	}{
+		{10, 15 * time.Second, 30},
+		{150, 15 * time.Second, 30},
+		{300, 30 * time.Second, 60},
+		{1000, 100 * time.Second, 200},
+	}
+	for _, test := range tests {
+		for i := len(sm.hosts); i < test.hosts; i++ {
+			sm.Add(netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)}))
+		}
+		if interval := sm.scrapeInterval(); interval != test.interval {
+			t.Errorf("%d hosts: Expected interval %v, got %v", test.hosts, test.interval, interval)
+		}
+		if timeout := sm.activeTimeout(); timeout != test.timeout {
+			t.Errorf("%d hosts: Expected active timeout %v, got %v", test.hosts, test.timeout, timeout)
+		}
+	}
+
+	// Slow scrapes stretch the interval further.
+	sm.recordScrapeDuration(150 * time.Second)
+	if interval := sm.scrapeInterval(); interval != 150*time.Second {
+		t.Errorf("Expected interval of the average scrape duration, got %v", interval)
+	}
+}
+
+func TestGetSubsetIPs(t *testing.T) {
+	sm := NewSessionManager()
+	sm.subsetSize = 3
+	for i := 1; i <= 20; i++ {
+		addActiveHost(sm, fmt.Sprintf("10.0.0.%d", i), 0)
+	}
+	subset := func(client string) map[string]bool {
+		ips := sm.GetClientIPs(netip.MustParseAddr(client), 0)
+		if len(ips) != 3 {
+			t.Fatalf("Expected 3 ips for %s, got %v", client, ips)
+		}
+		set := map[string]bool{}
+		for _, ip := range ips {
+			set[ip.String()] = true
+		}
+		return set
+	}
+	equal := func(a, b map[string]bool) bool {
+		for ip := range a {
+			if !b[ip] {
+				return false
+			}
+		}
+		return len(a) == len(b)
+	}
+
+	// Clients in the same subnet get the same subset, on every query.
+	first := subset("192.168.1.10")
+	for i := 0; i < 10; i++ {
+		if got := subset("192.168.1.20"); !equal(first, got) {
+			t.Fatalf("Expected stable subset %v, got %v", first, got)
+		}
+	}
+	// Clients in other subnets spread across the pool.
+	seen := map[string]bool{}
+	different := 0
+	for i := 0; i < 10; i++ {
+		got := subset(fmt.Sprintf("192.168.%d.1", 10+i))
+		if !equal(first, got) {
+			different++
+		}
+		for ip := range got {
+			seen[ip] = true
+		}
+	}
+	if different == 0 {
+		t.Errorf("Expected different subsets for different client subnets")
+	}
+	if len(seen) < 10 {
+		t.Errorf("Expected subsets to spread across the pool, got %v", seen)
+	}
+}
+
+func TestGetIPsHeadRotation(t *testing.T) {
+	sm := NewSessionManager()
+	sm.headRotation = 3
+	for i := 1; i <= 5; i++ {
+		addActiveHost(sm, fmt.Sprintf("10.0.0.%d", i), float32(10*i))
+	}
+
+	// The three least-loaded hosts take turns at the head, the others
+	// follow by load.
+	heads := []string{"10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"}
+	for i, head := range heads {
+		ips := sm.GetIPs()
+		if ips[0].String() != head {
+			t.Errorf("Query %d: Expected %s first, got %v", i, head, ips)
+		}
+		if tail := fmt.Sprint(ips[3:]); tail != "[10.0.0.4 10.0.0.5]" {
+			t.Errorf("Query %d: Expected the other hosts by load, got %v", i, ips)
+		}
+	}
+}
+
+func TestShuffledIPsSeed(t *testing.T) {
+	shuffled := func(seed int64) string {
+		sm := NewSessionManager()
+		sm.rng = newLockedRand(seed)
+		for i := 1; i <= 20; i++ {
+			sm.Add(netip.MustParseAddr(fmt.Sprintf("10.0.0.%d", i)))
+		}
+		return fmt.Sprint(sm.shuffledIPs(0), sm.shuffledIPs(0))
+	}
+	// The same seed shuffles alike, across managers and map orders.
+	if a, b := shuffled(1), shuffled(1); a != b {
+		t.Errorf("Expected the same shuffles with the same seed, got %v and %v", a, b)
+	}
+	if a, b := shuffled(1), shuffled(2); a == b {
+		t.Errorf("Expected different shuffles with different seeds, got %v", a)
+	}
+}
+
+func TestShuffleByLoad(t *testing.T) {
+	sm := NewSessionManager()
+	// Weights 1, 1/2 and 1/4.
+	hosts := []*Host{
+		addActiveHost(sm, "10.0.0.1", 0),
+		addActiveHost(sm, "10.0.0.2", 1),
+		addActiveHost(sm, "10.0.0.3", 3),
+	}
+	const n = 20000
+	firsts := map[string]int{}
+	for i := 0; i < n; i++ {
+		shuffled := append([]*Host(nil), hosts...)
+		sm.shuffleByLoad(shuffled)
+		firsts[shuffled[0].ip.String()]++
+	}
+	expected := map[string]float64{"10.0.0.1": 4.0 / 7, "10.0.0.2": 2.0 / 7, "10.0.0.3": 1.0 / 7}
+	for ip, p := range expected {
+		if got := float64(firsts[ip]) / n; math.Abs(got-p) > 0.02 {
+			t.Errorf("Expected %s first in %.3f of shuffles, got %.3f", ip, p, got)
+		}
+	}
+}
+
+func TestGetIPsWeightedDistribution(t *testing.T) {
+	sm := NewSessionManager()
+	sm.distribution = distributionWeighted
+	addActiveHost(sm, "10.0.0.1", 100)
+	addActiveHost(sm, "10.0.0.2", 100)
+
+	// Answers spread over equally loaded hosts, and the estimates follow.
+	for i := 0; i < 1000; i++ {
+		sm.GetIPs()
+	}
+	for _, host := range sm.active {
+		if host.estimate < 550 || host.estimate > 650 {
+			t.Errorf("Expected estimate of %s near 600, got %v", host.ip, host.estimate)
+		}
+	}
+}
+
+func TestGetClientIPsRendezvous(t *testing.T) {
+	sm := NewSessionManager()
+	sm.selection = selectionRendezvous
+	for i := 1; i <= 10; i++ {
+		addActiveHost(sm, fmt.Sprintf("10.0.0.%d", i), 100)
+	}
+	order := func(client string) []string {
+		hosts := sm.rendezvous(sm.activeHosts(0), netip.MustParseAddr(client))
+		ips := make([]string, 0, len(hosts))
+		for _, host := range hosts {
+			ips = append(ips, host.ip.String())
+		}
+		return ips
+	}
+
+	// Clients in the same subnet share a stable order, while subnets differ.
+	client := order("192.0.2.1")
+	if again := order("192.0.2.200"); !slices.Equal(client, again) {
+		t.Fatalf("Expected a stable order for the subnet, got %v and %v", client, again)
+	}
+	firsts := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		firsts[order(fmt.Sprintf("198.51.%d.1", i))[0]] = true
+	}
+	if len(firsts) < 2 {
+		t.Errorf("Expected subnets to prefer different hosts, got %v", firsts)
+	}
+
+	// An overloaded host is demoted, and the others keep their order.
+	preferred := sm.hosts[netip.MustParseAddr(client[0])]
+	preferred.estimate = 10000
+	demoted := order("192.0.2.1")
+	if demoted[0] == client[0] {
+		t.Fatalf("Expected overloaded host %s to be demoted, got %v", client[0], demoted)
+	}
+	rest := []string{}
+	for _, ip := range demoted {
+		if ip != client[0] {
+			rest = append(rest, ip)
+		}
+	}
+	if !slices.Equal(rest, client[1:]) {
+		t.Errorf("Expected the other hosts in order %v, got %v", client[1:], rest)
+	}
+
+	// Answers follow the order of the client subnet.
+	preferred.estimate = 100
+	ips := sm.GetClientIPs(netip.MustParseAddr("192.0.2.1"), 0)
+	if ips[0].String() != client[0] {
+		t.Errorf("Expected the preferred host %s first, got %v", client[0], ips)
+	}
+}
+
+func TestGetIPsActiveFloor(t *testing.T) {
+	sm := NewSessionManager()
+	sm.activeFloor = 3
+	addActiveHost(sm, "10.0.0.1", 5)
+	for i, ago := range []time.Duration{time.Minute, 3 * time.Minute, 2 * time.Minute} {
+		host := addTestHost(sm, netip.MustParseAddr(fmt.Sprintf("10.0.0.%d", i+2)), 0)
+		host.Update(0)
+		host.updated = time.Now().Add(-ago)
+	}
+	// Never scraped.
+	addTestHost(sm, netip.MustParseAddr("10.0.0.5"), 0)
+
+	ips := sm.GetIPs()
+	got := map[string]bool{}
+	for _, ip := range ips {
+		got[ip.String()] = true
+	}
+	if len(ips) != 3 || !got["10.0.0.1"] || !got["10.0.0.2"] || !got["10.0.0.4"] {
+		t.Errorf("Expected 10.0.0.1 and the two most recently seen hosts, got %v", ips)
+	}
+}
+
+func TestScrapeParseErrors(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	body := "connections{ 1\n"
+	ip, port := newTestTarget(t, "127.0.0.5", body)
+	host := addTestHost(sm, ip, port)
+	errors := func() float64 {
+		return testutil.ToFloat64(sessionScrapeParseErrors.WithLabelValues(ip.String()))
+	}
+	bytes := func() float64 {
+		return testutil.ToFloat64(sessionScrapeBytes.WithLabelValues(ip.String()))
+	}
+	beforeErrors, beforeBytes := errors(), bytes()
+
+	// The scrape fails to parse once more when retried.
+	sm.Scrape(host)
+	if got := errors() - beforeErrors; got != 1 {
+		t.Errorf("Expected 1 parse error, got %v", got)
+	}
+	if got := bytes() - beforeBytes; got != float64(2*len(body)) {
+		t.Errorf("Expected %d bytes scraped, got %v", 2*len(body), got)
+	}
+}
+
+func TestScrapeParseRetry(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	var scrapes int32
+	ip, port := newTestTargetHandler(t, "127.0.0.6", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&scrapes, 1) == 1 {
+			// Truncated mid-line.
+			fmt.Fprint(w, "# TYPE connections gauge\nconnections")
+			return
+		}
+		fmt.Fprint(w, testMetrics(8, 1))
+	}))
+	host := addTestHost(sm, ip, port)
+	retries := func() float64 {
+		return testutil.ToFloat64(sessionScrapeRetries.WithLabelValues(ip.String()))
+	}
+	errors := func() float64 {
+		return testutil.ToFloat64(sessionScrapeParseErrors.WithLabelValues(ip.String()))
+	}
+	beforeRetries, beforeErrors := retries(), errors()
+
+	sm.Scrape(host)
+	if host.estimate != 8 {
+		t.Errorf("Expected the retry to update the estimate to 8, got %v", host.estimate)
+	}
+	if got := retries() - beforeRetries; got != 1 {
+		t.Errorf("Expected 1 retry, got %v", got)
+	}
+	if got := errors() - beforeErrors; got != 0 {
+		t.Errorf("Expected no parse errors after a successful retry, got %v", got)
+	}
+}
+
+func TestScrapeClientError(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	var scrapes int32
+	ip, port := newTestTargetHandler(t, "127.0.0.6", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&scrapes, 1)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, testMetrics(8, 1))
+	}))
+	host := addTestHost(sm, ip, port)
+	failures := func() float64 {
+		return testutil.ToFloat64(sessionScrapeFailures.WithLabelValues(ip.String()))
+	}
+	errors := func() float64 {
+		return testutil.ToFloat64(sessionScrapeParseErrors.WithLabelValues(ip.String()))
+	}
+	beforeFailures, beforeErrors := failures(), errors()
+
+	// The body of a client error is not parsed, and the scrape not retried.
+	sm.Scrape(host)
+	if host.estimate != 0 || host.updated.Unix() != 0 {
+		t.Errorf("Expected no update from a 403 response, got estimate %v", host.estimate)
+	}
+	if scrapes != 1 {
+		t.Errorf("Expected a single request, got %d", scrapes)
+	}
+	if got := failures() - beforeFailures; got != 1 {
+		t.Errorf("Expected 1 scrape failure, got %v", got)
+	}
+	if got := errors() - beforeErrors; got != 0 {
+		t.Errorf("Expected no parse errors, got %v", got)
+	}
+}
+
+func TestScrapeBlend(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeBlend = []metricWeight{{"connections", 0.7}, {"cpu", 0.3}}
+	metrics := func(connections, cpu float64) string {
+		return fmt.Sprintf("# TYPE connections gauge\nconnections %v\n# TYPE cpu gauge\ncpu %v\n",
+			connections, cpu)
+	}
+
+	// Fewer connections, but busy enough to be ordered last.
+	ip, port := newTestTarget(t, "127.0.0.1", metrics(10, 90))
+	busy := addTestHost(sm, ip, port)
+	ip, port = newTestTarget(t, "127.0.0.2", metrics(20, 10))
+	idle := addTestHost(sm, ip, port)
+	for _, host := range []*Host{busy, idle} {
+		sm.Scrape(host)
+		sm.updateActive(host)
+	}
+
+	if busy.estimate != 34 || idle.estimate != 17 {
+		t.Errorf("Expected blended estimates 34 and 17, got %v and %v", busy.estimate, idle.estimate)
+	}
+	ips := sm.GetIPs()
+	if len(ips) != 2 || ips[0].String() != "127.0.0.2" {
+		t.Errorf("Expected 127.0.0.2 first, got %v", ips)
+	}
+}
+
+func TestGetIPsSample(t *testing.T) {
+	sm := NewSessionManager()
+	sm.tierWidth = 100
+	sm.sampleSize = 2
+	firstTier := map[string]bool{}
+	for i := 1; i <= 4; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		addActiveHost(sm, ip, float32(i))
+		firstTier[ip] = true
+	}
+	addActiveHost(sm, "10.0.0.5", 150)
+	addActiveHost(sm, "10.0.0.6", 250)
+
+	samples := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		ips := sm.GetIPs()
+		if len(ips) != 2 {
+			t.Fatalf("Query %d: Expected 2 ips, got %v", i, ips)
+		}
+		for _, ip := range ips {
+			if !firstTier[ip.String()] {
+				t.Errorf("Query %d: Expected %v in the first tier", i, ip)
+			}
+		}
+		samples[fmt.Sprint(ips)] = true
+	}
+	if len(samples) < 2 {
+		t.Errorf("Expected samples to vary across queries, got %v", samples)
+	}
+}
+
+func TestScrapeMaxBytes(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.scrapeMaxBytes = 1024
+
+	ip, port := newTestTarget(t, "127.0.0.1", testMetrics(1, 1))
+	small := addTestHost(sm, ip, port)
+	body := testMetrics(2, 1) + strings.Repeat("# padding\n", 1000)
+	ip, port = newTestTarget(t, "127.0.0.2", body)
+	large := addTestHost(sm, ip, port)
+	sm.Scrape(small)
+	sm.Scrape(large)
+
+	if small.estimate != 1 {
+		t.Errorf("Expected estimate 1 for the small scrape, got %v", small.estimate)
+	}
+	if large.estimate != 0 || large.updated.Unix() != 0 {
+		t.Errorf("Expected the large scrape to fail, got estimate %v updated %v",
+			large.estimate, large.updated)
+	}
+
+	// An endless body is not read past the limit and the drain.
+	ip, port = newTestTargetHandler(t, "127.0.0.3", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		padding := []byte(strings.Repeat("# padding\n", 1000))
+		for {
+			if _, err := w.Write(padding); err != nil {
+				return
+			}
+		}
+	}))
+	read := testutil.ToFloat64(sessionScrapeBytes.WithLabelValues(ip.String()))
+	sm.Scrape(addTestHost(sm, ip, port))
+	if n := testutil.ToFloat64(sessionScrapeBytes.WithLabelValues(ip.String())) - read; n > float64(sm.scrapeMaxBytes+1+maxDrainBytes) {
+		t.Errorf("Expected at most %d bytes read, got %v", sm.scrapeMaxBytes+1+maxDrainBytes, n)
+	}
+}
+
+func TestGetIPsResortEpsilon(t *testing.T) {
+	sm := NewSessionManager()
+	sm.resortEpsilon = 5
+	first := addActiveHost(sm, "10.0.0.1", 1)
+	second := addActiveHost(sm, "10.0.0.2", 3)
+	third := addActiveHost(sm, "10.0.0.3", 20)
+
+	if ips := sm.GetIPs(); ips[0].String() != "10.0.0.1" {
+		t.Fatalf("Expected 10.0.0.1 first, got %v", ips)
+	}
+	// Below the epsilon, the order is reused, with the head still incremented.
+	second.estimate = 0
+	if ips := sm.GetIPs(); ips[0].String() != "10.0.0.1" {
+		t.Errorf("Expected the order reused with 10.0.0.1 first, got %v", ips)
+	}
+	if first.estimate != 3 {
+		t.Errorf("Expected the head estimate incremented to 3, got %v", first.estimate)
+	}
+	// Past the epsilon, the hosts are sorted again.
+	third.estimate = 0.5
+	ips := sm.GetIPs()
+	expected := []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"}
+	for i, ip := range expected {
+		if ips[i].String() != ip {
+			t.Errorf("Expected %v after resort, got %v", expected, ips)
+			break
+		}
+	}
+}
+
+func TestGetIPsResortEpsilonTiers(t *testing.T) {
+	sm := NewSessionManager()
+	sm.resortEpsilon = 100
+	sm.tierWidth = 1000
+	sm.sampleSize = 2
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		addActiveHost(sm, ip, 0)
+	}
+	sm.GetIPs()
+	cached := append([]*Host(nil), sm.order[0]...)
+
+	// Cached orders still shuffle the first tier, and keep the cache intact.
+	heads := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		heads[sm.GetIPs()[0].String()] = true
+	}
+	if len(heads) < 2 {
+		t.Errorf("Expected the first tier shuffled with a cached order, got heads %v", heads)
+	}
+	if !slices.Equal(sm.order[0], cached) {
+		t.Errorf("Expected the cached order unchanged")
+	}
+}
+
+func TestGetIPsEstimateCeiling(t *testing.T) {
+	tests := []struct {
+		factor, max float32
+		expected    float32
+	}{
+		{0, 0, 30},
+		{2, 0, 20},
+		{0, 15, 15},
+		{3, 12, 12},
+	}
+	for _, test := range tests {
+		sm := NewSessionManager()
+		sm.estimateFactor = test.factor
+		sm.estimateMax = test.max
+		host := addActiveHost(sm, "10.0.0.1", 10)
+		// Scrapes stopped, while queries continue.
+		for i := 0; i < 20; i++ {
+			sm.GetIPs()
+		}
+		if host.estimate != test.expected {
+			t.Errorf("Factor %v max %v: Expected estimate %v, got %v",
+				test.factor, test.max, test.expected, host.estimate)
+		}
+	}
+}
+
+func TestScrapeConnectionReuse(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+
+	var conns int32
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetrics(5, 1))
+	}))
+	server.Listener = l
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	ap := netip.MustParseAddrPort(l.Addr().String())
+	host := addTestHost(sm, ap.Addr(), ap.Port())
+
+	for i := 0; i < 3; i++ {
+		sm.Scrape(host)
+	}
+	if host.base != 5 {
+		t.Errorf("Expected base 5, got %v", host.base)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Expected 1 connection across scrapes, got %v", n)
+	}
+}
+
+func TestScrapeLastScrapeTimestamp(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	ip, port := newTestTarget(t, "127.0.0.7", testMetrics(3, 1))
+	host := addTestHost(sm, ip, port)
+
+	sm.Scrape(host)
+	got := testutil.ToFloat64(sessionLastScrape.WithLabelValues(ip.String()))
+	expected := float64(host.updated.UnixNano()) / 1e9
+	if got != expected {
+		t.Errorf("Expected last scrape timestamp %v, got %v", expected, got)
+	}
+	if time.Since(time.Unix(int64(got), 0)) > time.Minute {
+		t.Errorf("Expected a recent last scrape timestamp, got %v", got)
+	}
+}
+
+func TestGetIPsGenerationJitter(t *testing.T) {
+	sm := NewSessionManager()
+	sm.tierWidth = 100
+	sm.generationJitter = true
+	for i := 1; i <= 4; i++ {
+		addActiveHost(sm, fmt.Sprintf("10.0.0.%d", i), float32(i))
+	}
+
+	orders := map[string]bool{}
+	for generation := 0; generation < 10; generation++ {
+		sm.scrapes = uint64(generation * len(sm.hosts))
+		order := fmt.Sprint(sm.GetIPs())
+		for i := 0; i < 5; i++ {
+			if got := fmt.Sprint(sm.GetIPs()); got != order {
+				t.Fatalf("Generation %d: Expected stable order %v, got %v", generation, order, got)
+			}
+		}
+		orders[order] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("Expected the order to change across generations, got %v", orders)
+	}
+}
+
+func TestGetIPsRotate(t *testing.T) {
+	sm := NewSessionManager()
+	sm.selection = selectionRotate
+	addActiveHost(sm, "10.0.0.1", 9)
+	addActiveHost(sm, "10.0.0.2", 1)
+	addActiveHost(sm, "10.0.0.3", 5)
+	// Inactive hosts are not rotated in.
+	sm.Add(netip.MustParseAddr("10.0.0.4"))
+
+	hosts := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	first := sm.GetIPs()[0].String()
+	offset := slices.Index(hosts, first)
+	if offset < 0 {
+		t.Fatalf("Expected an active host first, got %v", first)
+	}
+	for i := 1; i <= 6; i++ {
+		ips := sm.GetIPs()
+		expected := []string{}
+		for j := range hosts {
+			expected = append(expected, hosts[(offset+i+j)%len(hosts)])
+		}
+		if fmt.Sprint(ips) != fmt.Sprint(expected) {
+			t.Errorf("Query %d: Expected %v, got %v", i, expected, ips)
+		}
+	}
+}
+
+func TestScrapeConnectRetry(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.retries = 1
+	sm.retryDelay = time.Millisecond
+
+	var requests int32
+	ip, port := newTestTargetHandler(t, "127.0.0.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Drop the first connection without a response.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Failed to hijack connection: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, testMetrics(6, 1))
+	}))
+	host := addTestHost(sm, ip, port)
+	sm.Scrape(host)
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 requests, got %d", n)
+	}
+	if host.estimate != 6 {
+		t.Errorf("Expected estimate 6 after the retry, got %v", host.estimate)
+	}
+}
+
+func TestScrapeRetryBackoff(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.retryDelay = 10 * time.Millisecond
+
+	var requests int32
+	ip, port := newTestTargetHandler(t, "127.0.0.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, testMetrics(6, 1))
+	}))
+	host := addTestHost(sm, ip, port)
+	start := time.Now()
+	sm.Scrape(host)
+	sm.updateActive(host)
+
+	// Two retries, after 10ms and 20ms.
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Expected retries to back off for at least 30ms, took %v", elapsed)
+	}
+	if _, ok := sm.active[host.ip]; !ok || host.estimate != 6 {
+		t.Errorf("Expected host active with estimate 6 after the retries, got %v", host.estimate)
+	}
+
+	// Retries stop after the retry count.
+	atomic.StoreInt32(&requests, 0)
+	sm.retries = 1
+	sm.Scrape(host)
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 requests with 1 retry, got %d", n)
+	}
+}
+
+func TestScrapeHTTPTimeout(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.retries = 0
+	sm.client = newScrapeClient(20*time.Millisecond, DefaultIdleConnTimeout, nil)
+	ip, port := newTestTargetHandler(t, "127.0.0.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, testMetrics(6, 1))
+	}))
+	host := addTestHost(sm, ip, port)
+
+	start := time.Now()
+	sm.Scrape(host)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the scrape to time out after 20ms, took %v", elapsed)
+	}
+	if host.updated != time.Unix(0, 0) {
+		t.Errorf("Expected no update from the timed out scrape, got estimate %v", host.estimate)
+	}
+}
+
+func TestGetIPsCapacity(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.capacityMetric = "max_connections"
+	tests := []struct {
+		addr                 string
+		connections, maximum float64
+	}{
+		// Most sessions, but least used: 40% of capacity.
+		{"127.0.0.1", 40, 100},
+		// 50% of capacity.
+		{"127.0.0.2", 5, 10},
+		// Fewest sessions, but most used: 80% of capacity.
+		{"127.0.0.3", 4, 5},
+	}
+	for _, test := range tests {
+		body := fmt.Sprintf("%s# TYPE max_connections gauge\nmax_connections %v\n",
+			testMetrics(test.connections, 1), test.maximum)
+		ip, port := newTestTarget(t, test.addr, body)
+		host := addTestHost(sm, ip, port)
+		sm.Scrape(host)
+		sm.updateActive(host)
+	}
+
+	ips := sm.GetIPs()
+	if fmt.Sprint(ips) != "[127.0.0.1 127.0.0.2 127.0.0.3]" {
+		t.Errorf("Expected hosts ordered by free capacity, got %v", ips)
+	}
+	// An answer adds one session to the first host, as a share of its capacity.
+	host := sm.hosts[netip.MustParseAddr("127.0.0.1")]
+	if host.estimate != 41 {
+		t.Errorf("Expected 41%% of capacity in use, got %v", host.estimate)
+	}
+}
+
+func TestStopStartupScrape(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.startupDeadline = time.Minute
+	release := make(chan struct{})
+	defer close(release)
+	ip, port := newTestTargetHandler(t, "127.0.0.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	addTestHost(sm, ip, port)
+
+	started := make(chan struct{})
+	go func() {
+		sm.Start()
+		close(started)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	sm.Stop()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Stop to abort the startup scrape")
+	}
+}
+
+func TestStop(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	ip, port := newTestTarget(t, "127.0.0.1", testMetrics(2, 1))
+	sm.scrapePort = port
+	sm.Add(ip)
+	baseline := runtime.NumGoroutine()
+
+	sm.webhook = newWebhook("http://127.0.0.1:1/")
+	sm.Start()
+	for i := 0; !sm.Ready() && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !sm.Ready() {
+		t.Fatalf("Expected the host scraped")
+	}
+	sm.Stop()
+	n := runtime.NumGoroutine()
+	for i := 0; n > baseline && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	if n > baseline {
+		t.Errorf("Expected %d goroutines after Stop, got %d", baseline, n)
+	}
+}
+
+func TestGetIPsMaintenance(t *testing.T) {
+	sm := NewSessionManager()
+	sm.maintenance = &window{start: 22 * time.Hour, end: 2 * time.Hour}
+	first := addActiveHost(sm, "10.0.0.1", 1)
+	addActiveHost(sm, "10.0.0.2", 5)
+	// Inactive hosts are answered during maintenance.
+	sm.Add(netip.MustParseAddr("10.0.0.3"))
+
+	tests := []struct {
+		hour, minute int
+		maintenance  bool
+	}{
+		{12, 0, false},
+		{21, 59, false},
+		{22, 0, true},
+		{23, 30, true},
+		{1, 0, true},
+		{2, 0, false},
+	}
+	for _, test := range tests {
+		sm.now = func() time.Time {
+			return time.Date(2024, 3, 1, test.hour, test.minute, 0, 0, time.Local)
+		}
+		estimate := first.estimate
+		ips := sm.GetIPs()
+		if test.maintenance {
+			if len(ips) != 3 || first.estimate != estimate {
+				t.Errorf("%02d:%02d: Expected all hosts without steering, got %v (estimate %v)",
+					test.hour, test.minute, ips, first.estimate)
+			}
+			continue
+		}
+		if len(ips) != 2 || !ips[0].Equal(first.netIP) || first.estimate != estimate+1 {
+			t.Errorf("%02d:%02d: Expected active hosts with 10.0.0.1 first, got %v (estimate %v)",
+				test.hour, test.minute, ips, first.estimate)
+		}
+		// Keep 10.0.0.1 first.
+		first.estimate = estimate
+	}
+}
+
+// Run with -race to detect unguarded access to the hosts and the active set.
+func TestScrapeConcurrentGetIPs(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	hosts := []*Host{}
+	for i, addr := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		ip, port := newTestTarget(t, addr, testMetrics(float64(i), 1))
+		hosts = append(hosts, addTestHost(sm, ip, port))
+	}
+
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host *Host) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				sm.Scrape(host)
+				sm.updateActive(host)
+			}
+		}(host)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				sm.GetIPs()
+				sm.activeCount()
+			}
+		}()
+	}
+	wg.Wait()
+	if n := sm.activeCount(); n != len(hosts) {
+		t.Errorf("Expected %d active hosts, got %d", len(hosts), n)
+	}
+}
+
+func TestScrapeHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/actuator/prometheus" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testMetrics(7, 1))
+	}))
+	t.Cleanup(server.Close)
+	ap := netip.MustParseAddrPort(server.Listener.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tests := []struct {
+		name       string
+		skipVerify bool
+		rootCAs    *x509.CertPool
+		expected   float32
+	}{
+		{"unverified", false, nil, 0},
+		{"skip verify", true, nil, 7},
+		{"ca bundle", false, roots, 7},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sm := NewSessionManager()
+			sm.scrapeMetric = "connections"
+			sm.scrapeScheme = scrapeSchemeHTTPS
+			sm.scrapePath = "/actuator/prometheus"
+			sm.tlsSkipVerify = tc.skipVerify
+			sm.tlsRootCAs = tc.rootCAs
+			sm.client = newScrapeClient(DefaultHTTPTimeout, DefaultIdleConnTimeout, sm.tlsConfig())
+			host := addTestHost(sm, ap.Addr(), ap.Port())
+
+			sm.Scrape(host)
+			if host.base != tc.expected {
+				t.Errorf("Expected base %v, got %v", tc.expected, host.base)
+			}
+		})
+	}
+}
+
+func TestGetIPsEstimateHalfLife(t *testing.T) {
+	sm := NewSessionManager()
+	sm.estimateHalfLife = 10 * time.Second
+	host := addActiveHost(sm, "10.0.0.1", 10)
+	now := host.decayed
+	sm.now = func() time.Time { return now }
+	for i := 0; i < 8; i++ {
+		sm.GetIPs()
+	}
+	if host.estimate != 18 {
+		t.Fatalf("Expected estimate 18, got %v", host.estimate)
+	}
+
+	// Half of the answered sessions remain after each half-life.
+	for _, expected := range []float32{14, 12, 11} {
+		now = now.Add(sm.estimateHalfLife)
+		sm.decay()
+		if host.estimate != expected {
+			t.Errorf("Expected estimate %v, got %v", expected, host.estimate)
+		}
+	}
+}
+
+func TestUpdateActiveReason(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(io.Discard)
+
+	sm := NewSessionManager()
+	host := addActiveHost(sm, "10.0.0.1", 1)
+	delete(sm.active, host.ip)
+
+	tests := []struct {
+		update   func()
+		expected string
+	}{
+		{func() {}, "Add 10.0.0.1 to active list. reason: scraped"},
+		{func() { host.healthy = false }, "Remove 10.0.0.1 from active list. reason: health metric"},
+		{func() { host.healthy = true }, "Add 10.0.0.1 to active list. reason: scraped"},
+		{func() { host.updated = time.Unix(0, 0) }, "Remove 10.0.0.1 from active list. reason: scrape timeout"},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		test.update()
+		sm.updateActive(host)
+		if !strings.Contains(buf.String(), test.expected) {
+			t.Errorf("Expected log %q, got %q", test.expected, buf.String())
+		}
+	}
+
+	// Unchanged hosts are not logged.
+	buf.Reset()
+	sm.updateActive(host)
+	if buf.Len() != 0 {
+		t.Errorf("Expected no log, got %q", buf.String())
+	}
+}
+
+func TestUpdateActiveBoundary(t *testing.T) {
+	sm := NewSessionManager()
+	host := addActiveHost(sm, "10.0.0.1", 1)
+	timeout := time.Duration(sm.activeTimeout()) * time.Second
+
+	tests := []struct {
+		elapsed time.Duration
+		active  bool
+	}{
+		{0, true},
+		{timeout - time.Millisecond, true},
+		{timeout, false},
+		{timeout + time.Second, false},
+	}
+	for _, test := range tests {
+		sm.now = func() time.Time { return host.updated.Add(test.elapsed) }
+		sm.updateActive(host)
+		if _, active := sm.active[host.ip]; active != test.active {
+			t.Errorf("After %v: Expected active %v, got %v", test.elapsed, test.active, active)
+		}
+	}
+}
+
+func TestUpdateManagerClock(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeFailureWindow = time.Minute
+	host := addTestHost(sm, netip.MustParseAddr("10.0.0.1"), 0)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sm.now = func() time.Time { return now }
+
+	sm.update(host, 3)
+	if !host.updated.Equal(now) || !sm.lastScrapeSuccess.Equal(now) {
+		t.Errorf("Expected the host updated at %v, got %v", now, host.updated)
+	}
+	if !sm.fresh(host.netIP) {
+		t.Errorf("Expected the host fresh right after the update")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if sm.fresh(host.netIP) {
+		t.Errorf("Expected the host stale after 2 minutes")
+	}
+	sm.checkDegraded()
+	if !sm.degraded {
+		t.Errorf("Expected degraded mode 2 minutes after the last scrape")
+	}
+}
+
+func TestScrapeMetrics(t *testing.T) {
+	sm := NewSessionManager()
+	sm.name = "metrics.test"
+	sm.scrapeMetric = "connections"
+	ip, port := newTestTarget(t, "127.0.0.8", testMetrics(4, 1))
+	host := addTestHost(sm, ip, port)
+	dark := addTestHost(sm, netip.MustParseAddr("127.0.0.9"), 1)
+
+	sm.Scrape(host)
+	sm.updateActive(host)
+	sm.Scrape(dark)
+	sm.updateActive(dark)
+	if got := testutil.ToFloat64(sessionScrapeFailures.WithLabelValues(ip.String())); got != 0 {
+		t.Errorf("Expected no scrape failures of %v, got %v", ip, got)
+	}
+	if got := testutil.ToFloat64(sessionScrapeFailures.WithLabelValues("127.0.0.9")); got != 1 {
+		t.Errorf("Expected a scrape failure of 127.0.0.9, got %v", got)
+	}
+	if got := testutil.ToFloat64(sessionActiveHosts.WithLabelValues("metrics.test")); got != 1 {
+		t.Errorf("Expected 1 active host, got %v", got)
+	}
+
+	sm.GetIPs()
+	sm.GetIPs()
+	if got := testutil.ToFloat64(sessionHostEstimate.WithLabelValues(ip.String())); got != 6 {
+		t.Errorf("Expected host estimate 6, got %v", got)
+	}
+}
+
+// hasHostSeries returns whether the collector has a series of host.
+func hasHostSeries(c prometheus.Collector, host string) bool {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(metrics)
+		close(metrics)
+	}()
+	found := false
+	for metric := range metrics {
+		var m dto.Metric
+		metric.Write(&m)
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "host" && label.GetValue() == host {
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+func TestRemoveHostMetrics(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	ip, port := newTestTarget(t, "127.0.0.12", testMetrics(4, 1))
+	host := addTestHost(sm, ip, port)
+	sm.Scrape(host)
+	sm.updateActive(host)
+	sm.GetIPs()
+	// Series of every per host metric.
+	sessionScrapeParseErrors.WithLabelValues(ip.String()).Inc()
+	sessionScrapeFailures.WithLabelValues(ip.String()).Inc()
+	sessionScrapeRetries.WithLabelValues(ip.String()).Inc()
+	vectors := map[string]prometheus.Collector{
+		"selected":       sessionSelectedCount,
+		"last scrape":    sessionLastScrape,
+		"scrape bytes":   sessionScrapeBytes,
+		"parse errors":   sessionScrapeParseErrors,
+		"scrape failure": sessionScrapeFailures,
+		"host estimate":  sessionHostEstimate,
+		"retries":        sessionScrapeRetries,
+	}
+	for name, vector := range vectors {
+		if !hasHostSeries(vector, ip.String()) {
+			t.Fatalf("Expected a %s series of %v", name, ip)
+		}
+	}
+
+	sm.Remove(ip)
+	for name, vector := range vectors {
+		if hasHostSeries(vector, ip.String()) {
+			t.Errorf("Expected the %s series of %v deleted", name, ip)
+		}
+	}
+}
+
+func TestReadyQuorum(t *testing.T) {
+	sm := NewSessionManager()
+	sm.readyQuorum = 2
+	first := addActiveHost(sm, "10.0.0.1", 1)
+	addTestHost(sm, netip.MustParseAddr("10.0.0.2"), 0)
+	addTestHost(sm, netip.MustParseAddr("10.0.0.3"), 0)
+	// All hosts have been scraped, but only one successfully.
+	sm.unscraped = 0
+	if sm.Ready() {
+		t.Errorf("Expected not ready with 1 of 2 active hosts")
+	}
+	addActiveHost(sm, "10.0.0.4", 1)
+	if !sm.Ready() {
+		t.Errorf("Expected ready with 2 active hosts")
+	}
+	delete(sm.active, first.ip)
+	if sm.Ready() {
+		t.Errorf("Expected not ready after a host left the active set")
+	}
+}
+
+func TestGetIPsFallbackLastKnown(t *testing.T) {
+	sm := NewSessionManager()
+	sm.fallback = fallbackLastKnown
+	hosts := []*Host{}
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		addr := netip.MustParseAddr(ip)
+		sm.Add(addr)
+		hosts = append(hosts, sm.hosts[addr])
+		hosts[i].Update(float32(4 - i))
+	}
+	// Never active, so all known hosts are answered.
+	if ips := sm.GetIPs(); len(ips) != 4 {
+		t.Errorf("Expected all 4 hosts before any was active, got %v", ips)
+	}
+
+	// 10.0.0.1 was active in an earlier active set. 10.0.0.2 and 10.0.0.3
+	// are the last known active set, dropping out one by one.
+	sm.mutex.Lock()
+	sm.setActive(hosts[0], true, reasonScraped)
+	sm.setActive(hosts[0], false, reasonTimeout)
+	sm.setActive(hosts[1], true, reasonScraped)
+	sm.setActive(hosts[2], true, reasonScraped)
+	sm.setActive(hosts[1], false, reasonTimeout)
+	sm.setActive(hosts[2], false, reasonTimeout)
+	sm.mutex.Unlock()
+
+	ips := sm.GetIPs()
+	if len(ips) != 2 || ips[0].String() != "10.0.0.3" || ips[1].String() != "10.0.0.2" {
+		t.Errorf("Expected the last known active hosts 10.0.0.3 and 10.0.0.2, got %v", ips)
+	}
+
+	sm.fallback = fallbackNone
+	if ips := sm.GetIPs(); len(ips) != 0 {
+		t.Errorf("Expected no hosts, got %v", ips)
+	}
+}
+
+// A failed scrape within the active timeout keeps the host active with its
+// last estimate. The active timeout is the freshness window of the last
+// scraped value.
+func TestScrapeFailureKeepsActive(t *testing.T) {
+	sm := NewSessionManager()
+	sm.scrapeMetric = "connections"
+	sm.retries = 0
+	var failing atomic.Bool
+	ip, port := newTestTargetHandler(t, "127.0.0.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "exporter restarting", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, testMetrics(3, 1))
+	}))
+	host := addTestHost(sm, ip, port)
+	sm.Scrape(host)
+	sm.updateActive(host)
+	if _, ok := sm.active[ip]; !ok || host.estimate != 3 {
+		t.Fatalf("Expected the host active with estimate 3, got active %v, estimate %v", ok, host.estimate)
+	}
+
+	failing.Store(true)
+	scraped := time.Now()
+	sm.now = func() time.Time { return scraped.Add(sm.scrapeInterval()) }
+	sm.Scrape(host)
+	sm.updateActive(host)
+	if _, ok := sm.active[ip]; !ok || host.estimate != 3 {
+		t.Errorf("Expected the host to stay active with estimate 3 after one failed scrape, got active %v, estimate %v", ok, host.estimate)
+	}
+
+	sm.now = func() time.Time { return scraped.Add(time.Duration(sm.activeTimeout()+1) * time.Second) }
+	sm.Scrape(host)
+	sm.updateActive(host)
+	if _, ok := sm.active[ip]; ok {
+		t.Errorf("Expected the host inactive once the active timeout passed")
+	}
+}
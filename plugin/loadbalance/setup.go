@@ -1,12 +1,18 @@
 package loadbalance
 
 import (
+	"crypto/rand"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/netip"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
@@ -21,6 +27,51 @@ import (
 var log = clog.NewWithPlugin("loadbalance")
 var errOpen = errors.New("Weight file open error")
 
+// Parse failures that callers can match with errors.Is. They are returned
+// wrapped in a *ParseError, which carries the offending token.
+var (
+	ErrUnknownPolicy     = errors.New("unknown policy")
+	ErrMissingWeightFile = errors.New("missing weight file argument")
+	ErrInvalidTarget     = errors.New("invalid target")
+)
+
+// ParseError is a Corefile parse failure of Token at File:Line. Err is one of
+// the parse failures above and Cause, if set, the underlying error.
+type ParseError struct {
+	File  string
+	Line  int
+	Token string
+	Err   error
+	Cause error
+}
+
+func (e *ParseError) Error() string {
+	msg := e.Err.Error()
+	if e.Token != "" {
+		msg += fmt.Sprintf(" %q", e.Token)
+	}
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	if e.File == "" {
+		return msg
+	}
+	// Same format as caddy's Dispenser.Err.
+	return fmt.Sprintf("%s:%d - Error during parsing: %s", e.File, e.Line, msg)
+}
+
+func (e *ParseError) Unwrap() []error {
+	if e.Cause == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.Cause}
+}
+
+// parseErr returns a *ParseError of token at the current Corefile position.
+func parseErr(c *caddy.Controller, token string, err error) *ParseError {
+	return &ParseError{File: c.File(), Line: c.Line(), Token: token, Err: err}
+}
+
 func init() { plugin.Register("loadbalance", setup) }
 
 type lbFuncs struct {
@@ -37,7 +88,27 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return plugin.Error("loadbalance", err)
 	}
+	if lb == nil && session == nil {
+		return nil
+	}
 	if session != nil {
+		// Scraping starts with the server, so a configuration failing to
+		// load leaves neither scrapes behind nor replaces the pool.
+		c.OnStartup(func() error {
+			registerPool(session.pool, session.manager)
+			session.manager.Start()
+			return nil
+		})
+		c.OnShutdown(func() error {
+			session.manager.Stop()
+			return nil
+		})
+		if session.admin != nil {
+			c.OnStartup(session.admin.Start)
+			// Take the listener back if the new configuration failed.
+			c.OnRestartFailed(session.admin.Start)
+			c.OnShutdown(session.admin.Stop)
+		}
 		dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 			return LoadBalance{Next: next, shuffle: nil, session: session}
 		})
@@ -58,8 +129,18 @@ func setup(c *caddy.Controller) error {
 
 // func parse(c *caddy.Controller) (string, *weightedRR, error) {
 func parse(c *caddy.Controller) (*lbFuncs, *SessionLoadBalancer, error) {
+	defaults := false
+	// The session_defaults blocks of this server block, by name.
+	named := map[string][]sessionSetting{}
+	// The policy and arguments of directives without arguments, as set by
+	// default_policy. Empty shuffles randomly.
+	var policyArgs []string
 	for c.Next() {
 		args := c.RemainingArgs()
+		if len(args) == 0 {
+			// The configured default policy, if any, takes the block.
+			args = append([]string{}, policyArgs...)
+		}
 		if len(args) == 0 {
 			lb, err := parseRandomShuffle(c, args)
 			return lb, nil, err
@@ -69,29 +150,81 @@ func parse(c *caddy.Controller) (*lbFuncs, *SessionLoadBalancer, error) {
 			lb, err := parseRandomShuffle(c, args)
 			return lb, nil, err
 		case weightedRoundRobinPolicy:
-			lb, err := parseRandomShuffle(c, args)
+			lb, err := parseWeightedRoundRobin(c, args)
 			return lb, nil, err
 		case sessionPolicy:
-			session, err := parseSession(c, args)
+			session, err := parseSession(c, args, named)
 			return nil, session, err
+		case sessionDefaults:
+			if err := parseSessionDefaults(c, args, named); err != nil {
+				return nil, nil, err
+			}
+			defaults = true
+		case defaultPolicy:
+			policy, err := parseDefaultPolicy(c, args)
+			if err != nil {
+				return nil, nil, err
+			}
+			policyArgs = policy
+			defaults = true
 		default:
-			return nil, nil, fmt.Errorf("unknown policy: %s", args[0])
+			return nil, nil, parseErr(c, args[0], ErrUnknownPolicy)
 		}
 	}
+	if defaults {
+		// Only defaults, no load balancer.
+		return nil, nil, nil
+	}
 	return nil, nil, c.ArgErr()
 }
 
+// parseDefaultPolicy returns the policy and arguments of later loadbalance
+// directives without arguments.
+func parseDefaultPolicy(c *caddy.Controller, args []string) ([]string, error) {
+	if len(args) < 2 {
+		return nil, c.Errf("Expected policy parameters for %s", defaultPolicy)
+	}
+	switch args[1] {
+	case ramdomShufflePolicy, weightedRoundRobinPolicy, sessionPolicy:
+	default:
+		return nil, parseErr(c, args[1], ErrUnknownPolicy)
+	}
+	if c.NextBlock() {
+		return nil, c.Errf("%s takes no block", defaultPolicy)
+	}
+	return args[1:], nil
+}
+
 func parseRandomShuffle(c *caddy.Controller, args []string) (*lbFuncs, error) {
 	if len(args) > 1 {
 		return nil, c.Errf("unknown property for %s", args[0])
 	}
-	return &lbFuncs{shuffleFunc: randomShuffle}, nil
+	lb := &lbFuncs{shuffleFunc: randomShuffle}
+	for c.NextBlock() {
+		switch c.Val() {
+		case "prefer":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Err("expected a single address for prefer")
+			}
+			preferred, err := netip.ParseAddr(args[0])
+			if err != nil {
+				return nil, c.Errf("invalid preferred address: %s", args[0])
+			}
+			lb.shuffleFunc = func(res *dns.Msg) *dns.Msg {
+				return preferFirst(randomShuffle(res), preferred)
+			}
+		default:
+			return nil, c.Errf("unknown property '%s'", c.Val())
+		}
+	}
+	return lb, nil
 }
 
 func parseWeightedRoundRobin(c *caddy.Controller, args []string) (*lbFuncs, error) {
 	config := dnsserver.GetConfig(c)
 	if len(args) < 2 {
-		return nil, c.Err("missing weight file argument")
+		return nil, parseErr(c, "", ErrMissingWeightFile)
 	}
 
 	if len(args) > 2 {
@@ -128,13 +261,105 @@ func parseWeightedRoundRobin(c *caddy.Controller, args []string) (*lbFuncs, erro
 func checkSessionInputs(c *caddy.Controller, key string, args []string) error {
 	singleInputKeys := []string{
 		sessionDomain,
-		sessionScrapeMetric,
 		sessionScrapePort,
-		sessionScrapeTimeout}
-	multipleInputKeys := []string{sessionTargetIps}
+		sessionScrapeTimeout,
+		sessionActiveTimeout,
+		sessionHealthMetric,
+		sessionCapacityMetric,
+		sessionHealthThreshold,
+		sessionTierWidth,
+		sessionScrapeFailureWindow,
+		sessionSticky,
+		sessionScrapeFormat,
+		sessionScrapeJSONPath,
+		sessionStartupParallelism,
+		sessionStartupDeadline,
+		sessionMaxRate,
+		sessionWebhookURL,
+		sessionScrapeBudget,
+		sessionActiveFloor,
+		sessionSample,
+		sessionHeadRotation,
+		sessionExploreCount,
+		sessionTargetSample,
+		sessionMaxTargets,
+		sessionReadyQuorum,
+		sessionScrapeMaxBytes,
+		sessionResortEpsilon,
+		sessionUnready,
+		sessionCompression,
+		sessionFallback,
+		sessionEnabled,
+		sessionScrapeQuantile,
+		sessionScrapeBucket,
+		sessionFQDN,
+		sessionAdmin,
+		sessionAudit,
+		sessionScrapeParseRetries,
+		sessionScrapeConnectRetries,
+		sessionScrapeRetryCount,
+		sessionEstimateFactor,
+		sessionEstimateMax,
+		sessionEstimateHalfLife,
+		sessionScrapeIdleTimeout,
+		sessionScrapeHTTPTimeout,
+		sessionRepeat,
+		sessionMaxAnswers,
+		sessionScrapeScheduler,
+		sessionSelection,
+		sessionDistribution,
+		sessionTTL,
+		sessionScrapeScheme,
+		sessionScrapePath,
+		sessionScrapeCA}
+	multipleInputKeys := []string{
+		sessionTargetIps,
+		sessionScrapeMetric,
+		sessionRecordTypes,
+		sessionSOA,
+		sessionScrapeSubnetLimit,
+		sessionSubset,
+		sessionRecencyTTL,
+		sessionMaintenance,
+		sessionMetricPercentile,
+		sessionScrapeLabels,
+		sessionTargetDNS}
+	pairInputKeys := []string{sessionScrapeHeader}
 	numericInputKeys := []string{
 		sessionScrapePort,
-		sessionScrapeTimeout}
+		sessionScrapeTimeout,
+		sessionActiveTimeout,
+		sessionScrapeFailureWindow,
+		sessionSticky,
+		sessionStartupParallelism,
+		sessionStartupDeadline,
+		sessionActiveFloor,
+		sessionSample,
+		sessionHeadRotation,
+		sessionExploreCount,
+		sessionTargetSample,
+		sessionMaxTargets,
+		sessionReadyQuorum,
+		sessionScrapeMaxBytes,
+		sessionAudit,
+		sessionScrapeParseRetries,
+		sessionScrapeConnectRetries,
+		sessionScrapeRetryCount,
+		sessionScrapeIdleTimeout,
+		sessionScrapeHTTPTimeout,
+		sessionEstimateHalfLife,
+		sessionRepeat,
+		sessionMaxAnswers}
+	floatInputKeys := []string{
+		sessionHealthThreshold,
+		sessionTierWidth,
+		sessionMaxRate,
+		sessionScrapeBudget,
+		sessionResortEpsilon,
+		sessionEstimateFactor,
+		sessionEstimateMax,
+		sessionScrapeQuantile,
+		sessionScrapeBucket}
 	if slices.Contains(singleInputKeys, key) {
 		if len(args) != 1 {
 			return c.Err("Expected single parameters for " + key)
@@ -145,6 +370,11 @@ func checkSessionInputs(c *caddy.Controller, key string, args []string) error {
 			return c.Err("Expected 1+ parameters for " + key)
 		}
 	}
+	if slices.Contains(pairInputKeys, key) {
+		if len(args) != 2 {
+			return c.Err("Expected key and value parameters for " + key)
+		}
+	}
 	if slices.Contains(numericInputKeys, key) {
 		value := args[0]
 		_, err := strconv.ParseInt(value, 10, 32)
@@ -154,89 +384,748 @@ func checkSessionInputs(c *caddy.Controller, key string, args []string) error {
 			return c.Err(msg)
 		}
 	}
+	if slices.Contains(floatInputKeys, key) {
+		value := args[0]
+		_, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to parse %s: %v is not a number",
+				key, value)
+			return c.Err(msg)
+		}
+	}
 	return nil
 }
 
-func parseSession(c *caddy.Controller, args []string) (*SessionLoadBalancer, error) {
+func parseSession(c *caddy.Controller, args []string, named map[string][]sessionSetting) (*SessionLoadBalancer, error) {
 	if len(args) != 2 {
 		msg := fmt.Sprintf("Expected 'session' and hostname parameters. Got: %v", args)
 		return nil, c.Err(msg)
 	}
 	session := NewSessionLoadBalancer()
-	session.hostname = args[1]
+	if _, ok := dns.IsDomainName(args[1]); !ok {
+		return nil, c.Errf("Invalid hostname: %s", args[1])
+	}
+	// Query names are matched in lower case.
+	session.hostname = strings.ToLower(strings.TrimSuffix(args[1], "."))
+	session.manager.name = session.hostname
+	// Flags take no parameters.
+	flags := map[string]*bool{
+		sessionLogDecisions:        &session.logDecisions,
+		sessionUpstream:            &session.upstream,
+		sessionPreferLocal:         &session.manager.preferLocal,
+		sessionObserveOnly:         &session.observeOnly,
+		sessionFirstQuestion:       &session.firstQuestion,
+		sessionGenerationJitter:    &session.manager.generationJitter,
+		sessionDiagnostics:         &session.diagnostics,
+		sessionBestEffort:          &session.bestEffort,
+		sessionNXDomain:            &session.nxdomain,
+		sessionScrapeTLSSkipVerify: &session.manager.tlsSkipVerify,
+		sessionScrapeMetricSuffix:  &session.manager.metricSuffix,
+		sessionDebugEndpoint:       &session.debugEndpoint,
+	}
+	settings := []sessionSetting{}
+	targets := []string{}
+	targetSample := 0
+	maxTargets := DefaultMaxTargets
 	for c.NextBlock() {
 		key := c.Val()
 		args := c.RemainingArgs()
-		checkSessionInputs(c, key, args)
+		if key != sessionDefaults {
+			settings = append(settings, sessionSetting{key: key, args: args})
+			continue
+		}
+		// Inherit the named defaults. Later keys override them.
+		if len(args) != 1 {
+			return nil, c.Err("Expected single parameters for " + key)
+		}
+		defaults, ok := named[args[0]]
+		if !ok {
+			return nil, c.Errf("Unknown %s: %s", key, args[0])
+		}
+		settings = append(settings, defaults...)
+	}
+	for _, setting := range settings {
+		key, args := setting.key, setting.args
+		if flag, ok := flags[key]; ok {
+			if len(args) != 0 {
+				return nil, c.Err("Expected no parameters for " + key)
+			}
+			*flag = true
+			continue
+		}
+		if err := checkSessionInputs(c, key, args); err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return nil, c.Err("Expected parameters for " + key)
+		}
 		value := args[0]
 		i, _ := strconv.ParseInt(value, 10, 32)
 		switch key {
 		case sessionTargetIps:
-			ips, err := parseTargetIps(args)
-			if err != nil {
-				return nil, c.Err(fmt.Sprintf("%v", err))
+			// Parsed below, once the sample size is known.
+			targets = append(targets, args...)
+		case sessionTargetDNS:
+			if len(args) > 2 {
+				return nil, c.Errf("Expected name and optional interval for %s", key)
+			}
+			if _, ok := dns.IsDomainName(value); !ok {
+				return nil, c.Errf("Invalid %s: %s", key, value)
+			}
+			session.manager.targetDNS = value
+			if len(args) == 2 {
+				seconds, err := strconv.ParseUint(args[1], 10, 32)
+				if err != nil || seconds == 0 {
+					return nil, c.Errf("Failed to parse %s interval: %v is not a positive number", key, args[1])
+				}
+				session.manager.targetDNSInterval = time.Duration(seconds) * time.Second
 			}
-			for _, ip := range ips {
-				session.manager.Add(ip)
+		case sessionTargetSample:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
 			}
+			targetSample = int(i)
+		case sessionReadyQuorum:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.readyQuorum = uint(i)
+		case sessionMaxTargets:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			maxTargets = int(i)
 		case sessionDomain:
-			session.domain = value
+			session.domain = strings.ToLower(strings.TrimSuffix(value, "."))
+		case sessionFQDN:
+			if _, ok := dns.IsDomainName(value); !ok || dns.CountLabel(value) < 2 {
+				return nil, c.Errf("Invalid %s: %s", key, value)
+			}
+			session.fqdn = dns.CanonicalName(value)
 		case sessionScrapeMetric:
-			session.manager.scrapeMetric = value
+			if len(args) == 1 && !strings.Contains(value, ":") {
+				session.manager.scrapeMetric = value
+				break
+			}
+			blend, err := parseMetricWeights(args)
+			if err != nil {
+				return nil, c.Errf("Failed to parse %s: %v", key, err)
+			}
+			session.manager.scrapeBlend = blend
+		case sessionScrapeLabels:
+			labels, err := parseLabels(args)
+			if err != nil {
+				return nil, c.Errf("Failed to parse %s: %v", key, err)
+			}
+			session.manager.scrapeLabels = labels
 		case sessionScrapePort:
+			if i <= 0 || i > math.MaxUint16 {
+				return nil, c.Errf("Invalid %s: %s", key, value)
+			}
 			session.manager.scrapePort = uint16(i)
-		case sessionScrapeTimeout:
-			session.manager.scrapeTimeoutSeconds = uint(i)
+		case sessionActiveTimeout, sessionScrapeTimeout:
+			// session_scrape_timeout is the former name.
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.activeTimeoutSeconds = uint(i)
+		case sessionCapacityMetric:
+			session.manager.capacityMetric = value
+		case sessionHealthMetric:
+			session.manager.healthMetric = value
+		case sessionHealthThreshold:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, c.Errf("Failed to parse %s: %v is not a number", key, value)
+			}
+			session.manager.healthThreshold = f
+		case sessionTierWidth:
+			f, err := strconv.ParseFloat(value, 32)
+			if err != nil || f < 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number", key, value)
+			}
+			session.manager.tierWidth = float32(f)
+		case sessionScrapeFailureWindow:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.scrapeFailureWindow = time.Duration(i) * time.Second
+		case sessionScrapeHeader:
+			if len(args) != 2 {
+				return nil, c.Err("Expected key and value parameters for " + key)
+			}
+			session.manager.scrapeHeaders.Add(args[0], args[1])
+		case sessionTTL:
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, c.Errf("Failed to parse %s: %v is not a number of seconds", key, value)
+			}
+			session.ttl = uint32(ttl)
+		case sessionSticky:
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || ttl == 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number of seconds", key, value)
+			}
+			session.stickyTTL = uint32(ttl)
+		case sessionRecencyTTL:
+			if len(args) != 2 {
+				return nil, c.Errf("Expected fresh and stale TTL for %s", key)
+			}
+			fresh, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil || fresh == 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number of seconds", key, args[0])
+			}
+			stale, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil || stale == 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number of seconds", key, args[1])
+			}
+			session.freshTTL, session.staleTTL = uint32(fresh), uint32(stale)
+		case sessionMaintenance:
+			if len(args) != 2 {
+				return nil, c.Errf("Expected start and end time for %s", key)
+			}
+			w, err := parseWindow(args[0], args[1])
+			if err != nil {
+				return nil, c.Errf("Failed to parse %s: %v", key, err)
+			}
+			session.manager.maintenance = w
+		case sessionScrapeFormat:
+			if _, ok := extractors[value]; !ok {
+				return nil, c.Errf("Unknown %s: %s", key, value)
+			}
+			session.manager.scrapeFormat = value
+		case sessionScrapeScheduler:
+			scheduler, ok := schedulers[value]
+			if !ok {
+				return nil, c.Errf("Unknown %s: %s", key, value)
+			}
+			session.manager.scheduler = scheduler
+		case sessionSelection:
+			if value != selectionLeast && value != selectionRotate && value != selectionRendezvous {
+				return nil, c.Errf("Unknown %s: %s", key, value)
+			}
+			session.manager.selection = value
+		case sessionDistribution:
+			if value != distributionSorted && value != distributionWeighted {
+				return nil, c.Errf("Unknown %s: %s", key, value)
+			}
+			session.manager.distribution = value
+		case sessionUnready:
+			if value != unreadyPassthrough && value != unreadyFallback && value != unreadyServfail {
+				return nil, c.Errf("Unknown %s: %s", key, value)
+			}
+			session.unready = value
+		case sessionEnabled:
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, c.Errf("Failed to parse %s: %v is not a boolean", key, value)
+			}
+			session.enabled = enabled
+		case sessionFallback:
+			if value != fallbackAll && value != fallbackNone && value != fallbackLastKnown {
+				return nil, c.Errf("Unknown %s: %s", key, value)
+			}
+			session.manager.fallback = value
+		case sessionCompression:
+			if value != compressionOn && value != compressionOff {
+				return nil, c.Errf("Unknown %s: %s", key, value)
+			}
+			session.compression = value
+		case sessionScrapeJSONPath:
+			session.manager.scrapeJSONPath = value
+		case sessionStartupParallelism:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.startupParallelism = uint(i)
+		case sessionStartupDeadline:
+			session.manager.startupDeadline = time.Duration(i) * time.Second
+		case sessionScrapeQuantile:
+			f, _ := strconv.ParseFloat(value, 64)
+			if f <= 0 || f > 1 {
+				return nil, c.Errf("%s must be above 0 and at most 1", key)
+			}
+			session.manager.scrapeQuantile = f
+		case sessionScrapeBucket:
+			f, _ := strconv.ParseFloat(value, 64)
+			if f <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.scrapeBucket = f
+		case sessionMaxRate:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f < 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number", key, value)
+			}
+			session.manager.maxRate = f
+		case sessionScrapeBudget:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f <= 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number", key, value)
+			}
+			session.manager.scrapeBudget = f
+		case sessionEstimateFactor:
+			f, err := strconv.ParseFloat(value, 32)
+			if err != nil || f <= 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number", key, value)
+			}
+			session.manager.estimateFactor = float32(f)
+		case sessionEstimateMax:
+			f, err := strconv.ParseFloat(value, 32)
+			if err != nil || f <= 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number", key, value)
+			}
+			session.manager.estimateMax = float32(f)
+		case sessionEstimateHalfLife:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.estimateHalfLife = time.Duration(i) * time.Second
+		case sessionResortEpsilon:
+			f, err := strconv.ParseFloat(value, 32)
+			if err != nil || f < 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number", key, value)
+			}
+			session.manager.resortEpsilon = float32(f)
+		case sessionSOA:
+			if len(args) < 2 || len(args) > 3 {
+				return nil, c.Errf("Expected name server, mailbox and optional TTL for %s", key)
+			}
+			ttl := uint64(DefaultSOATTL)
+			if len(args) == 3 {
+				var err error
+				ttl, err = strconv.ParseUint(args[2], 10, 32)
+				if err != nil {
+					return nil, c.Errf("Failed to parse %s TTL: %v is not a number", key, args[2])
+				}
+			}
+			session.soa = newSOA(args[0], args[1], uint32(ttl))
+		case sessionScrapeSubnetLimit:
+			if len(args) > 2 {
+				return nil, c.Errf("Expected limit and optional prefix length for %s", key)
+			}
+			if i <= 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number", key, value)
+			}
+			session.manager.subnetLimit = uint(i)
+			if len(args) == 2 {
+				bits, err := strconv.ParseUint(args[1], 10, 8)
+				if err != nil || bits > 128 {
+					return nil, c.Errf("Failed to parse %s prefix length: %v", key, args[1])
+				}
+				session.manager.subnetBits = int(bits)
+			}
+		case sessionMetricPercentile:
+			if len(args) > 2 {
+				return nil, c.Errf("Expected percentile and optional window for %s", key)
+			}
+			p, err := strconv.ParseFloat(value, 64)
+			if err != nil || p <= 0 || p > 100 {
+				return nil, c.Errf("Failed to parse %s: %v is not a percentile", key, value)
+			}
+			session.manager.percentile = p
+			if len(args) == 2 {
+				window, err := strconv.ParseUint(args[1], 10, 16)
+				if err != nil || window == 0 {
+					return nil, c.Errf("Failed to parse %s window: %v is not a positive number", key, args[1])
+				}
+				session.manager.percentileWindow = int(window)
+			}
+		case sessionScrapeIdleTimeout:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.idleTimeout = time.Duration(i) * time.Second
+		case sessionScrapeHTTPTimeout:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.httpTimeout = time.Duration(i) * time.Second
+		case sessionScrapeScheme:
+			if value != scrapeSchemeHTTP && value != scrapeSchemeHTTPS {
+				return nil, c.Errf("Unknown %s: %s", key, value)
+			}
+			session.manager.scrapeScheme = value
+		case sessionScrapePath:
+			// The leading slash is optional.
+			session.manager.scrapePath = "/" + strings.TrimLeft(value, "/")
+		case sessionScrapeCA:
+			// Relative paths are relative to the root, like weight files.
+			if root := dnsserver.GetConfig(c).Root; !filepath.IsAbs(value) && root != "" {
+				value = filepath.Join(root, value)
+			}
+			pem, err := os.ReadFile(value)
+			if err != nil {
+				return nil, c.Errf("Failed to read %s: %v", key, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, c.Errf("No certificates found in %s: %s", key, value)
+			}
+			session.manager.tlsRootCAs = pool
+		case sessionScrapeMaxBytes:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.scrapeMaxBytes = i
+		case sessionMaxAnswers:
+			// Zero answers all hosts.
+			if i < 0 {
+				return nil, c.Errf("%s must not be negative", key)
+			}
+			session.maxAnswers = uint(i)
+		case sessionRepeat:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.repeatMax = uint(i)
+		case sessionExploreCount:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.exploreCount = uint(i)
+		case sessionHeadRotation:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.headRotation = uint(i)
+		case sessionSample:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.sampleSize = uint(i)
+		case sessionActiveFloor:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.manager.activeFloor = uint(i)
+		case sessionSubset:
+			if len(args) > 2 {
+				return nil, c.Errf("Expected size and optional prefix length for %s", key)
+			}
+			if i <= 0 {
+				return nil, c.Errf("Failed to parse %s: %v is not a positive number", key, value)
+			}
+			session.manager.subsetSize = uint(i)
+			if len(args) == 2 {
+				bits, err := strconv.ParseUint(args[1], 10, 8)
+				if err != nil || bits > 128 {
+					return nil, c.Errf("Failed to parse %s prefix length: %v", key, args[1])
+				}
+				session.manager.subsetBits = int(bits)
+			}
+		case sessionScrapeParseRetries:
+			if i < 0 {
+				return nil, c.Errf("%s must not be negative", key)
+			}
+			session.manager.parseRetries = uint(i)
+		case sessionScrapeRetryCount, sessionScrapeConnectRetries:
+			// session_scrape_connect_retries is the former name.
+			if i < 0 {
+				return nil, c.Errf("%s must not be negative", key)
+			}
+			session.manager.retries = uint(i)
+		case sessionAudit:
+			if i <= 0 {
+				return nil, c.Errf("%s must be positive", key)
+			}
+			session.audit = newAudit(int(i))
+		case sessionAdmin:
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, c.Errf("Invalid %s: %v", key, err)
+			}
+			session.admin = newAdmin(value, session)
+		case sessionWebhookURL:
+			u, err := url.Parse(value)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, c.Errf("Invalid %s: %s", key, value)
+			}
+			session.manager.webhook = newWebhook(value)
+		case sessionRecordTypes:
+			session.recordTypes = map[uint16]bool{}
+			for _, arg := range args {
+				qtype := dns.StringToType[strings.ToUpper(arg)]
+				if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+					return nil, c.Errf("Unsupported %s: %s", key, arg)
+				}
+				session.recordTypes[qtype] = true
+			}
 		default:
 			return nil, c.Err("Unknown parameter: " + key)
 		}
 	}
-	session.manager.Start()
+	ips, err := parseTargetIps(targets, targetSample, maxTargets)
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		perr.File, perr.Line = c.File(), c.Line()
+		return nil, perr
+	}
+	if err != nil {
+		return nil, c.Errf("%v. Raise %s, or sample large prefixes with %s", err, sessionMaxTargets, sessionTargetSample)
+	}
+	for _, ip := range ips {
+		session.manager.AddPort(ip.Addr(), ip.Port())
+		session.manager.staticTargets = append(session.manager.staticTargets, ip.Addr())
+	}
+	if quorum := session.manager.readyQuorum; quorum > uint(len(session.manager.hosts)) && session.manager.targetDNS == "" {
+		return nil, c.Errf("%s %d exceeds the %d target hosts", sessionReadyQuorum, quorum, len(session.manager.hosts))
+	}
+	if session.manager.scrapeFormat == scrapeFormatJSON && session.manager.scrapeJSONPath == "" {
+		return nil, c.Errf("%s is required for %s %s", sessionScrapeJSONPath, sessionScrapeFormat, scrapeFormatJSON)
+	}
+	if timeout, interval := session.manager.activeTimeoutSeconds, session.manager.scrapeIntervalSeconds; timeout < 2*interval {
+		// A single slow or failed scrape would flap hosts out of the active set.
+		return nil, c.Errf("%s %d is shorter than two scrape intervals of %d seconds", sessionActiveTimeout, timeout, interval)
+	}
+	if session.debugEndpoint && session.admin == nil {
+		return nil, c.Errf("%s requires %s", sessionDebugEndpoint, sessionAdmin)
+	}
+	if session.fqdn != "" && session.domain != "" && !dns.IsSubDomain(dns.Fqdn(session.domain), session.fqdn) {
+		return nil, c.Errf("%s %s is not in %s %s", sessionFQDN, session.fqdn, sessionDomain, session.domain)
+	}
+	if session.fqdn == "" {
+		log.Warningf("Matching %s by its first labels is deprecated. Use %s.", session.hostname, sessionFQDN)
+	}
+	if session.nxdomain && (session.soa == nil || session.domain == "") {
+		return nil, c.Errf("%s requires %s and %s", sessionNXDomain, sessionSOA, sessionDomain)
+	}
+	if session.manager.capacityMetric != "" && session.manager.scrapeFormat != scrapeFormatPrometheus {
+		return nil, c.Errf("%s requires %s %s", sessionCapacityMetric, sessionScrapeFormat, scrapeFormatPrometheus)
+	}
+	if len(session.manager.scrapeLabels) > 0 && (session.manager.scrapeFormat != scrapeFormatPrometheus || len(session.manager.scrapeBlend) > 0) {
+		return nil, c.Errf("%s requires a single %s in the %s format", sessionScrapeLabels, sessionScrapeMetric, scrapeFormatPrometheus)
+	}
+	singlePrometheus := session.manager.scrapeFormat == scrapeFormatPrometheus && len(session.manager.scrapeBlend) == 0
+	if session.manager.scrapeQuantile > 0 && !singlePrometheus {
+		return nil, c.Errf("%s requires a single %s in the %s format", sessionScrapeQuantile, sessionScrapeMetric, scrapeFormatPrometheus)
+	}
+	if session.manager.scrapeBucket > 0 && !singlePrometheus {
+		return nil, c.Errf("%s requires a single %s in the %s format", sessionScrapeBucket, sessionScrapeMetric, scrapeFormatPrometheus)
+	}
+	if session.manager.scrapeScheme != scrapeSchemeHTTPS {
+		if session.manager.tlsSkipVerify {
+			return nil, c.Errf("%s requires %s %s", sessionScrapeTLSSkipVerify, sessionScrapeScheme, scrapeSchemeHTTPS)
+		}
+		if session.manager.tlsRootCAs != nil {
+			return nil, c.Errf("%s requires %s %s", sessionScrapeCA, sessionScrapeScheme, scrapeSchemeHTTPS)
+		}
+	}
+	session.manager.repeatHosts = session.maxAnswers
+	if timeout, interval := session.manager.httpTimeout, session.manager.scrapeIntervalSeconds; timeout > time.Duration(interval)*time.Second {
+		// Scrapes would overlap the next scrape of the host.
+		return nil, c.Errf("%s %v exceeds the scrape interval of %d seconds", sessionScrapeHTTPTimeout, timeout.Seconds(), interval)
+	}
+	session.manager.client = newScrapeClient(session.manager.httpTimeout, session.manager.idleTimeout, session.manager.tlsConfig())
+	// Pools are identified by their zone, hostname and domain.
+	session.pool = strings.Join([]string{dnsserver.GetConfig(c).Zone, session.hostname, session.domain}, " ")
+	session.manager.setDefaultPorts()
 	session.PrintConfig()
 	return session, nil
 }
 
+// sessionSetting is a key and its parameters in a session block.
+type sessionSetting struct {
+	key  string
+	args []string
+}
+
+// parseSessionDefaults stores the settings of a named session_defaults
+// block in named, to be inherited by session pools. The settings are checked
+// when a pool inherits them.
+func parseSessionDefaults(c *caddy.Controller, args []string, named map[string][]sessionSetting) error {
+	if len(args) != 2 {
+		msg := fmt.Sprintf("Expected '%s' and name parameters. Got: %v", sessionDefaults, args)
+		return c.Err(msg)
+	}
+	settings := []sessionSetting{}
+	for c.NextBlock() {
+		key := c.Val()
+		if key == sessionDefaults || key == sessionTargetIps || key == sessionTargetDNS {
+			return c.Errf("%s not supported in %s", key, sessionDefaults)
+		}
+		settings = append(settings, sessionSetting{key: key, args: c.RemainingArgs()})
+	}
+	named[args[1]] = settings
+	return nil
+}
+
 // TODO(leffler): Move the functions below to some utility function or file.
 
-func increment(ip net.IP) {
-	for i := len(ip) - 1; i >= 0; i-- {
-		ip[i]++
-		if ip[i] > 0 {
-			break
+// parseMetricWeights parses a list of METRIC:WEIGHT pairs.
+func parseMetricWeights(args []string) ([]metricWeight, error) {
+	blend := []metricWeight{}
+	for _, arg := range args {
+		name, weight, ok := strings.Cut(arg, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected METRIC:WEIGHT, got %s", arg)
+		}
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil {
+			return nil, fmt.Errorf("weight of %s is not a number: %s", name, weight)
 		}
+		blend = append(blend, metricWeight{name: name, weight: w})
 	}
+	return blend, nil
 }
 
-func expandNetworkPrefix(prefix string) (addrs []netip.Addr, err error) {
-	ipv4, ipv4Net, err := net.ParseCIDR(prefix)
+// parseLabels parses KEY=VALUE label pairs. The value may be quoted, as in
+// the Prometheus text format.
+func parseLabels(args []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected KEY=VALUE, got %s", arg)
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// expandNetworkPrefix returns the addresses of prefix, IPv4 or IPv6. If sample
+// is positive and the prefix has more usable addresses, sample distinct random
+// addresses are returned instead. Returns an error, without expanding the
+// prefix, if there would be more than limit addresses.
+func expandNetworkPrefix(prefix string, sample, limit int) (addrs []netip.Addr, err error) {
+	network, err := netip.ParsePrefix(prefix)
 	if err != nil {
 		return addrs, err
 	}
+	network = network.Masked()
+	tooLarge := fmt.Errorf("%s expands to more than %d targets", prefix, limit)
+	hostBits := network.Addr().BitLen() - network.Bits()
+	if sample > 0 && (hostBits >= 63 || 1<<hostBits-reservedAddrs(network) > sample) {
+		if sample > limit {
+			return addrs, tooLarge
+		}
+		return samplePrefix(network, sample), nil
+	}
+	if hostBits >= 63 || 1<<hostBits > limit {
+		return addrs, tooLarge
+	}
+	addrs = make([]netip.Addr, 0, 1<<hostBits)
+	// Next returns the invalid zero address past the end of the address space.
+	for addr := network.Addr(); addr.IsValid() && network.Contains(addr); addr = addr.Next() {
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
 
-	for ip := ipv4.Mask(ipv4Net.Mask); ipv4Net.Contains(ip); increment(ip) {
-		if addr, ok := netip.AddrFromSlice(ip); ok {
+// reservedAddrs returns the number of addresses of the masked network that
+// are never sampled: the network and broadcast addresses of IPv4 prefixes
+// shorter than /31.
+func reservedAddrs(network netip.Prefix) int {
+	if network.Addr().Is4() && network.Bits() < 31 {
+		return 2
+	}
+	return 0
+}
+
+// samplePrefix returns n distinct random addresses of the network, which
+// must be masked and have more than n usable addresses.
+func samplePrefix(network netip.Prefix, n int) []netip.Addr {
+	seen := make(map[netip.Addr]bool, n)
+	if reservedAddrs(network) > 0 {
+		seen[network.Addr()] = true
+		seen[lastAddr(network)] = true
+	}
+	addrs := make([]netip.Addr, 0, n)
+	base := network.Addr().AsSlice()
+	ip := make([]byte, len(base))
+	for len(addrs) < n {
+		// Only fails without a system randomness source.
+		rand.Read(ip)
+		// Keep the network bits of the base address.
+		for i := range ip {
+			bits := network.Bits() - 8*i
+			switch {
+			case bits >= 8:
+				ip[i] = base[i]
+			case bits > 0:
+				mask := byte(0xff << (8 - bits))
+				ip[i] = base[i]&mask | ip[i]&^mask
+			}
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		if !seen[addr] {
+			seen[addr] = true
 			addrs = append(addrs, addr)
 		}
 	}
-	return addrs, nil
+	return addrs
+}
+
+// lastAddr returns the last address of the masked network.
+func lastAddr(network netip.Prefix) netip.Addr {
+	ip := network.Addr().AsSlice()
+	for i := range ip {
+		bits := network.Bits() - 8*i
+		switch {
+		case bits <= 0:
+			ip[i] = 0xff
+		case bits < 8:
+			ip[i] |= 0xff >> bits
+		}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr
 }
 
-func parseTargetIps(prefixes []string) ([]netip.Addr, error) {
-	addrs := []netip.Addr{}
+// parseWindow parses a daily window from start to end, as HH:MM times of day.
+func parseWindow(start, end string) (*window, error) {
+	offsets := [2]time.Duration{}
+	for i, value := range []string{start, end} {
+		t, err := time.Parse("15:04", value)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a HH:MM time of day", value)
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if offsets[0] == offsets[1] {
+		return nil, fmt.Errorf("empty window %s to %s", start, end)
+	}
+	return &window{start: offsets[0], end: offsets[1]}, nil
+}
+
+// parseTargetIps parses at most max target hosts. Hosts without a port have
+// port 0. Prefixes with more than sample addresses are sampled, if sample is
+// positive.
+func parseTargetIps(prefixes []string, sample, max int) ([]netip.AddrPort, error) {
+	addrs := []netip.AddrPort{}
 	for _, prefix := range prefixes {
 		// Try parse as single IP: a.b.c.d
 		ip, err := netip.ParseAddr(prefix)
 		if err == nil {
-			addrs = append(addrs, ip)
+			addrs = append(addrs, netip.AddrPortFrom(ip, 0))
+			continue
+		}
+		// Try parse as IP and port: a.b.c.d:p or [a::b]:p
+		ap, err := netip.ParseAddrPort(prefix)
+		if err == nil {
+			if ap.Port() == 0 {
+				return addrs, &ParseError{Token: prefix, Err: ErrInvalidTarget, Cause: errors.New("invalid port")}
+			}
+			addrs = append(addrs, ap)
 			continue
 		}
 		// If that didn't work, try parsing as cidr: a.b.c.d/e
-		ips, err := expandNetworkPrefix(prefix)
+		if _, err := netip.ParsePrefix(prefix); err != nil {
+			return addrs, &ParseError{Token: prefix, Err: ErrInvalidTarget, Cause: err}
+		}
+		ips, err := expandNetworkPrefix(prefix, sample, max-len(addrs))
 		if err != nil {
 			log.Infof("Error: %v", err)
 			return addrs, err
 		}
-		addrs = append(addrs, ips...)
+		for _, ip := range ips {
+			addrs = append(addrs, netip.AddrPortFrom(ip, 0))
+		}
+	}
+	if len(addrs) > max {
+		return addrs, fmt.Errorf("more than %d targets", max)
 	}
 	return addrs, nil
 }
@@ -1,10 +1,17 @@
 package loadbalance
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	testutil "github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
 )
 
 // weighted round robin specific test data
@@ -35,8 +42,17 @@ func TestSetup(t *testing.T) {
 		{`loadbalance weighted wf {
                                                 reload 0s
                                               } `, false, "weighted", "", 2},
+		{`loadbalance round_robin {
+                                                prefer 10.0.0.1
+                                              } `, false, "round_robin", "", -1},
 		// negative
 		{`loadbalance fleeb`, true, "", "unknown policy", -1},
+		{`loadbalance round_robin {
+                                                   prefer foo
+                                                 } `, true, "", "invalid preferred address", -1},
+		{`loadbalance round_robin {
+                                                   prefer
+                                                 } `, true, "", "expected a single address for prefer", -1},
 		{`loadbalance round_robin a`, true, "", "unknown property", -1},
 		{`loadbalance weighted`, true, "", "missing weight file argument", -1},
 		{`loadbalance weighted a b`, true, "", "unexpected argument", -1},
@@ -53,7 +69,7 @@ func TestSetup(t *testing.T) {
 
 	for i, test := range tests {
 		c := caddy.NewTestController("dns", test.input)
-		lb, err := parse(c)
+		lb, _, err := parse(c)
 
 		if test.shouldErr && err == nil {
 			t.Errorf("Test %d: Expected error but found %s for input %s", i, err, test.input)
@@ -98,3 +114,790 @@ func TestSetup(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupDefaultPolicy(t *testing.T) {
+	c := caddy.NewTestController("dns", `loadbalance default_policy weighted wfile`)
+	if lb, session, err := parse(c); err != nil || lb != nil || session != nil {
+		t.Fatalf("Expected only the default policy, got %v, %v, %v", lb, session, err)
+	}
+	c = caddy.NewTestController("dns", `loadbalance default_policy weighted wfile
+	loadbalance {
+		reload 10s
+	}`)
+	lb, _, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if lb.weighted == nil || lb.weighted.fileName != "wfile" || lb.weighted.reload != 10*time.Second {
+		t.Errorf("Expected the weighted policy with wfile, reloaded every 10s")
+	}
+	// The default policy doesn't carry over to another server block.
+	c = caddy.NewTestController("dns", `loadbalance`)
+	if lb, _, err := parse(c); err != nil || lb.weighted != nil {
+		t.Errorf("Expected the random shuffle, got %v, %v", lb, err)
+	}
+
+	c = caddy.NewTestController("dns", `loadbalance default_policy fleeb`)
+	if _, _, err := parse(c); !errors.Is(err, ErrUnknownPolicy) {
+		t.Errorf("Expected %v, got %v", ErrUnknownPolicy, err)
+	}
+	c = caddy.NewTestController("dns", `loadbalance default_policy`)
+	if _, _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for default_policy without a policy")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   error
+		token string
+	}{
+		{`loadbalance fleeb`, ErrUnknownPolicy, "fleeb"},
+		{`loadbalance weighted`, ErrMissingWeightFile, ""},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1 foo
+		}`, ErrInvalidTarget, "foo"},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1:0
+		}`, ErrInvalidTarget, "10.0.0.1:0"},
+	}
+	for _, tc := range tests {
+		c := caddy.NewTestController("dns", tc.input)
+		_, _, err := parse(c)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("Expected %v for %q, got %v", tc.err, tc.input, err)
+			continue
+		}
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("Expected a *ParseError for %q, got %T", tc.input, err)
+			continue
+		}
+		if perr.Token != tc.token {
+			t.Errorf("Expected token %q for %q, got %q", tc.token, tc.input, perr.Token)
+		}
+		if !strings.Contains(err.Error(), "Error during parsing: "+tc.err.Error()) {
+			t.Errorf("Expected the parse position in %q", err)
+		}
+	}
+}
+
+func TestSetupSession(t *testing.T) {
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedErrContent string // substring from the expected error. Empty for positive cases.
+		check              func(*SessionLoadBalancer) error
+	}{
+		// positive
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_health_metric up
+			session_health_threshold 0.5
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.healthMetric != "up" || s.manager.healthThreshold != 0.5 {
+				return fmt.Errorf("expected health metric up/0.5, got %s/%v",
+					s.manager.healthMetric, s.manager.healthThreshold)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.healthMetric != "" || s.manager.healthThreshold != DefaultHealthThreshold {
+				return fmt.Errorf("expected no health metric, got %s/%v",
+					s.manager.healthMetric, s.manager.healthThreshold)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_scrape_header Authorization "Bearer token"
+			session_scrape_header X-Route a
+			session_scrape_header X-Route b
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			headers := s.manager.scrapeHeaders
+			if headers.Get("Authorization") != "Bearer token" {
+				return fmt.Errorf("expected Authorization header, got %v", headers)
+			}
+			if route := headers.Values("X-Route"); len(route) != 2 || route[0] != "a" || route[1] != "b" {
+				return fmt.Errorf("expected X-Route headers a and b, got %v", route)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_scrape_format json
+			session_scrape_json_path stats.connections
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.scrapeFormat != scrapeFormatJSON || s.manager.scrapeJSONPath != "stats.connections" {
+				return fmt.Errorf("expected json format with path stats.connections, got %s/%s",
+					s.manager.scrapeFormat, s.manager.scrapeJSONPath)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1 fd00::1
+			session_record_types a AAAA
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if len(s.recordTypes) != 2 || !s.recordTypes[dns.TypeA] || !s.recordTypes[dns.TypeAAAA] {
+				return fmt.Errorf("expected record types A and AAAA, got %v", s.recordTypes)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_log_decisions
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if !s.logDecisions || s.upstream {
+				return fmt.Errorf("expected decision logging only")
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_upstream
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if !s.upstream || s.logDecisions {
+				return fmt.Errorf("expected upstream only")
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_soa ns.example.org hostmaster.example.org 60
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.soa == nil || s.soa.Ns != "ns.example.org." || s.soa.Mbox != "hostmaster.example.org." || s.soa.Minttl != 60 {
+				return fmt.Errorf("expected SOA ns.example.org. hostmaster.example.org. 60, got %v", s.soa)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_scrape_metric connections:0.7 cpu:0.3
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			blend := s.manager.scrapeBlend
+			if len(blend) != 2 || blend[0] != (metricWeight{"connections", 0.7}) || blend[1] != (metricWeight{"cpu", 0.3}) {
+				return fmt.Errorf("expected connections:0.7 cpu:0.3, got %v", blend)
+			}
+			return nil
+		}},
+		{`loadbalance session_defaults scrape {
+			session_scrape_metric connections
+			session_scrape_port 9100
+			session_prefer_local
+		}
+		loadbalance session lb {
+			session_defaults scrape
+			session_scrape_port 9200
+			session_target_ips 10.0.0.1
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			m := s.manager
+			if m.scrapeMetric != "connections" || m.scrapePort != 9200 || !m.preferLocal {
+				return fmt.Errorf("expected inherited metric and prefer local, and overridden port 9200, got %v %v %v",
+					m.scrapeMetric, m.scrapePort, m.preferLocal)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1:9200 [fd00::1]:9300 10.0.0.2
+			session_scrape_port 9100
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			return expectPorts(s, map[string]uint16{"10.0.0.1": 9200, "fd00::1": 9300, "10.0.0.2": 9100})
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1:9200 10.0.0.2
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			return expectPorts(s, map[string]uint16{"10.0.0.1": 9200, "10.0.0.2": DefaultScrapePort})
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_maintenance 22:30 02:00
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			w := s.manager.maintenance
+			if w == nil || w.start != 22*time.Hour+30*time.Minute || w.end != 2*time.Hour {
+				return fmt.Errorf("expected maintenance from 22:30 to 02:00, got %v", w)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_scrape_scheme https
+			session_scrape_path actuator/prometheus
+			session_scrape_tls_skip_verify
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.scrapePath != "/actuator/prometheus" {
+				return fmt.Errorf("expected path /actuator/prometheus, got %v", s.manager.scrapePath)
+			}
+			host := s.manager.hosts[netip.MustParseAddr("10.0.0.1")]
+			if url := s.manager.scrapeURL(host); url != "https://10.0.0.1:443/actuator/prometheus" {
+				return fmt.Errorf("expected the https URL on the default port, got %v", url)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.1.0.0/16 10.2.0.1
+			session_target_sample 10
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if n := len(s.manager.hosts); n != 11 {
+				return fmt.Errorf("expected 11 hosts, got %d", n)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1 10.0.0.2
+			session_ready_quorum 1
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.readyQuorum != 1 {
+				return fmt.Errorf("expected ready quorum 1, got %v", s.manager.readyQuorum)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_metric_percentile 90 20
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.percentile != 90 || s.manager.percentileWindow != 20 {
+				return fmt.Errorf("expected p90 of 20 scrapes, got p%v of %v",
+					s.manager.percentile, s.manager.percentileWindow)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_scrape_metric tcp_connections
+			session_scrape_labels state="established" port=53
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			labels := s.manager.scrapeLabels
+			if len(labels) != 2 || labels["state"] != "established" || labels["port"] != "53" {
+				return fmt.Errorf("expected labels state=established port=53, got %v", labels)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_selection rendezvous
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.selection != selectionRendezvous || !s.perClient() {
+				return fmt.Errorf("expected rendezvous selection per client, got %v", s.manager.selection)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_scrape_retries 0
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.retries != 0 {
+				return fmt.Errorf("expected no retries, got %v", s.manager.retries)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_head_rotation 3
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.headRotation != 3 {
+				return fmt.Errorf("expected head rotation 3, got %v", s.manager.headRotation)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_scrape_http_timeout 5
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.httpTimeout != 5*time.Second || s.manager.client.Timeout != 5*time.Second {
+				return fmt.Errorf("expected HTTP timeout 5s, got %v (client %v)", s.manager.httpTimeout, s.manager.client.Timeout)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_target_dns backend.example 10
+			session_ready_quorum 2
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.targetDNS != "backend.example" || s.manager.targetDNSInterval != 10*time.Second {
+				return fmt.Errorf("expected target DNS backend.example every 10s, got %v every %v", s.manager.targetDNS, s.manager.targetDNSInterval)
+			}
+			if len(s.manager.staticTargets) != 1 {
+				return fmt.Errorf("expected 1 static target, got %v", s.manager.staticTargets)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_compression off
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.compression != compressionOff {
+				return fmt.Errorf("expected compression off, got %q", s.compression)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_fallback last_known
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.fallback != fallbackLastKnown {
+				return fmt.Errorf("expected fallback last_known, got %q", s.manager.fallback)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_enabled false
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.enabled {
+				return fmt.Errorf("expected the pool disabled")
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_scrape_metric request_duration_seconds
+			session_scrape_quantile 0.99
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.manager.scrapeQuantile != 0.99 {
+				return fmt.Errorf("expected quantile 0.99, got %v", s.manager.scrapeQuantile)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_fqdn LB.Example.com
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.fqdn != "lb.example.com." {
+				return fmt.Errorf("expected FQDN lb.example.com., got %q", s.fqdn)
+			}
+			return nil
+		}},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1
+			session_ttl 60
+		}`, false, "", func(s *SessionLoadBalancer) error {
+			if s.ttl != 60 {
+				return fmt.Errorf("expected TTL 60, got %v", s.ttl)
+			}
+			return nil
+		}},
+		// negative
+		{`loadbalance session lb {
+			session_soa ns.example.org hostmaster.example.org
+			session_nxdomain
+		}`, true, "session_nxdomain requires session_soa and session_domain", nil},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.0/16
+		}`, true, "10.0.0.0/16 expands to more than 4096 targets. Raise session_max_targets", nil},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1 10.0.0.2
+			session_ready_quorum 3
+		}`, true, "session_ready_quorum 3 exceeds the 2 target hosts", nil},
+		{`loadbalance session lb {
+			session_scrape_timeout 10
+		}`, true, "session_active_timeout 10 is shorter than two scrape intervals of 15 seconds", nil},
+		{`loadbalance session lb {
+			session_active_timeout 20
+		}`, true, "session_active_timeout 20 is shorter than two scrape intervals of 15 seconds", nil},
+		{`loadbalance session lb {
+			session_scrape_timeout 0
+		}`, true, "session_scrape_timeout must be positive", nil},
+		{`loadbalance session lb {
+			session_metric_percentile 101
+		}`, true, "Failed to parse session_metric_percentile: 101 is not a percentile", nil},
+		{`loadbalance session lb {
+			session_metric_percentile 90 0
+		}`, true, "Failed to parse session_metric_percentile window: 0 is not a positive number", nil},
+		{`loadbalance session lb {
+			session_scrape_labels established
+		}`, true, "Failed to parse session_scrape_labels: expected KEY=VALUE, got established", nil},
+		{`loadbalance session lb {
+			session_scrape_metric connections:1 cpu:1
+			session_scrape_labels state=established
+		}`, true, "session_scrape_labels requires a single session_scrape_metric in the prometheus format", nil},
+		{`loadbalance session lb {
+			session_distribution random
+		}`, true, "Unknown session_distribution: random", nil},
+		{`loadbalance session lb {
+			session_scrape_http_timeout 20
+		}`, true, "session_scrape_http_timeout 20 exceeds the scrape interval of 15 seconds", nil},
+		{`loadbalance session lb {
+			session_explore_count 0
+		}`, true, "session_explore_count must be positive", nil},
+		{`loadbalance session lb {
+			session_target_dns backend.example 0
+		}`, true, "session_target_dns interval", nil},
+		{`loadbalance session lb {
+			session_target_dns backend.example 10 20
+		}`, true, "Expected name and optional interval", nil},
+		{`loadbalance session lb {
+			session_compression maybe
+		}`, true, "Unknown session_compression: maybe", nil},
+		{`loadbalance session lb {
+			session_debug_endpoint
+		}`, true, "session_debug_endpoint requires session_admin", nil},
+		{`loadbalance session lb {
+			session_fallback random
+		}`, true, "Unknown session_fallback: random", nil},
+		{`loadbalance session lb {
+			session_enabled maybe
+		}`, true, "Failed to parse session_enabled", nil},
+		{`loadbalance session lb {
+			session_scrape_quantile 99
+		}`, true, "session_scrape_quantile must be above 0 and at most 1", nil},
+		{`loadbalance session lb {
+			session_scrape_bucket 0.5
+			session_scrape_format json
+			session_scrape_json_path load
+		}`, true, "session_scrape_bucket requires a single session_scrape_metric in the prometheus format", nil},
+		{`loadbalance session lb {
+			session_fqdn lb.example.com
+			session_domain example.org
+		}`, true, "session_fqdn lb.example.com. is not in session_domain example.org", nil},
+		{`loadbalance session lb {
+			session_fqdn lb
+		}`, true, "Invalid session_fqdn: lb", nil},
+		{`loadbalance session lb {
+			session_scrape_failure_window 0
+		}`, true, "session_scrape_failure_window must be positive", nil},
+		{`loadbalance session lb {
+			session_scrape_failure_window -5
+		}`, true, "session_scrape_failure_window must be positive", nil},
+		{`loadbalance session lb {
+			session_ttl -1
+		}`, true, "Failed to parse session_ttl: -1 is not a number of seconds", nil},
+		{`loadbalance session lb {
+			session_target_sample 0
+		}`, true, "session_target_sample must be positive", nil},
+		{`loadbalance session lb {
+			session_scrape_scheme ftp
+		}`, true, "Unknown session_scrape_scheme: ftp", nil},
+		{`loadbalance session lb {
+			session_scrape_tls_skip_verify
+		}`, true, "session_scrape_tls_skip_verify requires session_scrape_scheme https", nil},
+		{`loadbalance session lb {
+			session_scrape_scheme https
+			session_scrape_ca /nonexistent/ca.pem
+		}`, true, "Failed to read session_scrape_ca", nil},
+		{`loadbalance session lb..x {
+		}`, true, "Invalid hostname", nil},
+		{`loadbalance session lb {
+			session_target_ips 10.0.0.1:0
+		}`, true, "invalid port", nil},
+		{`loadbalance session lb {
+			session_maintenance 22:00
+		}`, true, "Expected start and end time for session_maintenance", nil},
+		{`loadbalance session lb {
+			session_maintenance 22:00 25:00
+		}`, true, "25:00 is not a HH:MM time of day", nil},
+		{`loadbalance session lb {
+			session_scrape_port foo
+		}`, true, "Failed to parse session_scrape_port: foo is not a number", nil},
+		{`loadbalance session lb {
+			session_health_threshold high
+		}`, true, "Failed to parse session_health_threshold: high is not a number", nil},
+		{`loadbalance session lb {
+			session_domain example.org example.com
+		}`, true, "Expected single parameters for session_domain", nil},
+		{`loadbalance session lb {
+			session_domain
+		}`, true, "Expected single parameters for session_domain", nil},
+		{`loadbalance session lb {
+			session_target_ips
+		}`, true, "Expected 1+ parameters for session_target_ips", nil},
+		{`loadbalance session lb {
+			session_scrape_header Authorization
+		}`, true, "Expected key and value parameters for session_scrape_header", nil},
+		{`loadbalance session lb {
+			session_unknown
+		}`, true, "Expected parameters for session_unknown", nil},
+		{`loadbalance session lb {
+			session_scrape_port 0
+		}`, true, "Invalid session_scrape_port", nil},
+		{`loadbalance session lb {
+			session_defaults unknown
+		}`, true, "Unknown session_defaults: unknown", nil},
+		// The defaults of another server block don't carry over.
+		{`loadbalance session lb {
+			session_defaults scrape
+			session_target_ips 10.0.0.1
+		}`, true, "Unknown session_defaults: scrape", nil},
+		{`loadbalance session_defaults scrape {
+			session_target_ips 10.0.0.1
+		}`, true, "not supported in session_defaults", nil},
+		{`loadbalance session lb {
+			session_scrape_metric connections cpu:0.3
+		}`, true, "expected METRIC:WEIGHT", nil},
+		{`loadbalance session lb {
+			session_soa ns.example.org
+		}`, true, "Expected name server, mailbox", nil},
+		{`loadbalance session lb {
+			session_log_decisions yes
+		}`, true, "Expected no parameters", nil},
+		{`loadbalance session lb {
+			session_record_types A MX
+		}`, true, "Unsupported session_record_types: MX", nil},
+		{`loadbalance session lb {
+			session_scrape_format json
+		}`, true, "session_scrape_json_path is required", nil},
+		{`loadbalance session lb {
+			session_scrape_format xml
+		}`, true, "Unknown session_scrape_format", nil},
+		{`loadbalance session lb {
+			session_scrape_header X-Route
+		}`, true, "Expected key and value", nil},
+		{`loadbalance session lb {
+			session_health_threshold high
+		}`, true, "not a number", nil},
+		{`loadbalance session lb {
+			session_scrape_budget 0
+		}`, true, "not a positive number", nil},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, session, err := parse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error but found nil for input %s", i, test.input)
+			continue
+		}
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v",
+					i, test.input, err)
+			}
+			if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s",
+					i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err := test.check(session); err != nil {
+			t.Errorf("Test %d: %v for input %s", i, err, test.input)
+		}
+	}
+}
+
+// expectPorts returns an error if the hosts are not scraped on the expected ports.
+func expectPorts(s *SessionLoadBalancer, expected map[string]uint16) error {
+	for ip, port := range expected {
+		host, ok := s.manager.hosts[netip.MustParseAddr(ip)]
+		if !ok {
+			return fmt.Errorf("expected host %s", ip)
+		}
+		if host.port != port {
+			return fmt.Errorf("expected host %s on port %d, got %d", ip, port, host.port)
+		}
+	}
+	return nil
+}
+
+func TestSetupSessionReload(t *testing.T) {
+	input := `loadbalance session reload {
+			session_target_ips %s
+		}`
+	c := caddy.NewTestController("dns", fmt.Sprintf(input, "10.1.0.1 10.1.0.2"))
+	_, first, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if first.manager.started {
+		t.Fatalf("Expected scraping to start with the server, not at parse time")
+	}
+	// The startup of the server registers the pool.
+	registerPool(first.pool, first.manager)
+	kept := netip.MustParseAddr("10.1.0.1")
+	first.manager.hosts[kept].Update(7)
+	first.manager.active[kept] = first.manager.hosts[kept]
+
+	// Reload with 10.1.0.2 removed and 10.1.0.3 added.
+	c = caddy.NewTestController("dns", fmt.Sprintf(input, "10.1.0.1 10.1.0.3"))
+	_, second, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	registerPool(second.pool, second.manager)
+	m := second.manager
+	if len(m.hosts) != 2 || m.hosts[netip.MustParseAddr("10.1.0.3")] == nil {
+		t.Fatalf("Expected hosts 10.1.0.1 and 10.1.0.3, got %v", m.ListIPs())
+	}
+	if host := m.hosts[kept]; host.estimate != 7 || m.active[kept] != host {
+		t.Errorf("Expected unchanged host to keep estimate 7 and stay active, got %v", host.estimate)
+	}
+	if added := m.hosts[netip.MustParseAddr("10.1.0.3")]; added.estimate != 0 {
+		t.Errorf("Expected added host without estimate, got %v", added.estimate)
+	}
+}
+
+func TestSetupWeightedShuffle(t *testing.T) {
+	weightFile, rm, err := testutil.TempFile(".", `
+w1.example.org
+192.168.1.15 1
+192.168.1.14 254
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm()
+
+	c := caddy.NewTestController("dns", fmt.Sprintf(`loadbalance weighted %s {
+		reload 0s
+	}`, weightFile))
+	lb, _, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if lb.weighted == nil || lb.onStartUpFunc == nil || lb.onShutdownFunc == nil {
+		t.Fatalf("Expected weighted policy with startup and shutdown functions")
+	}
+	if err := lb.onStartUpFunc(); err != nil {
+		t.Fatalf("Expected weight file loaded, got %v", err)
+	}
+	defer lb.onShutdownFunc()
+
+	top := map[string]int{}
+	for i := 0; i < 100; i++ {
+		res := new(dns.Msg)
+		res.SetQuestion("w1.example.org.", dns.TypeA)
+		res.Answer = []dns.RR{
+			testutil.A("w1.example.org. 300 IN A 192.168.1.15"),
+			testutil.A("w1.example.org. 300 IN A 192.168.1.14"),
+		}
+		res = lb.shuffleFunc(res)
+		top[res.Answer[0].(*dns.A).A.String()]++
+	}
+	// 192.168.1.15 is first with a probability of 1/255.
+	if top["192.168.1.14"] < 90 {
+		t.Errorf("Expected answers ordered by weight, got top records %v", top)
+	}
+}
+
+func TestExpandNetworkPrefixSample(t *testing.T) {
+	addrs, err := expandNetworkPrefix("10.1.0.0/16", 100, DefaultMaxTargets)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(addrs) != 100 {
+		t.Fatalf("Expected 100 addresses, got %d", len(addrs))
+	}
+	prefix := netip.MustParsePrefix("10.1.0.0/16")
+	seen := map[netip.Addr]bool{}
+	for _, addr := range addrs {
+		if !prefix.Contains(addr) {
+			t.Errorf("Expected %v in %v", addr, prefix)
+		}
+		if seen[addr] {
+			t.Errorf("Expected distinct addresses, got %v twice", addr)
+		}
+		seen[addr] = true
+	}
+
+	addrs, err = expandNetworkPrefix("fd00::/64", 100, DefaultMaxTargets)
+	if err != nil || len(addrs) != 100 {
+		t.Fatalf("Expected 100 addresses, got %d, error %v", len(addrs), err)
+	}
+	for _, addr := range addrs {
+		if !netip.MustParsePrefix("fd00::/64").Contains(addr) {
+			t.Errorf("Expected %v in fd00::/64", addr)
+		}
+	}
+
+	// Prefixes within the sample size are expanded.
+	addrs, err = expandNetworkPrefix("10.1.0.0/24", 256, DefaultMaxTargets)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(addrs) != 256 {
+		t.Errorf("Expected 256 addresses, got %d", len(addrs))
+	}
+}
+
+func TestExpandNetworkPrefixSampleReserved(t *testing.T) {
+	// A /24 has 254 usable addresses, all sampled but the network and broadcast addresses.
+	addrs, err := expandNetworkPrefix("10.1.0.0/24", 253, DefaultMaxTargets)
+	if err != nil || len(addrs) != 253 {
+		t.Fatalf("Expected 253 addresses, got %d, error %v", len(addrs), err)
+	}
+	for _, addr := range addrs {
+		if addr == netip.MustParseAddr("10.1.0.0") || addr == netip.MustParseAddr("10.1.0.255") {
+			t.Errorf("Expected no network or broadcast address, got %v", addr)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		addrs, _ := expandNetworkPrefix("10.1.0.4/30", 1, DefaultMaxTargets)
+		if len(addrs) != 1 || (addrs[0] != netip.MustParseAddr("10.1.0.5") && addrs[0] != netip.MustParseAddr("10.1.0.6")) {
+			t.Fatalf("Expected 10.1.0.5 or 10.1.0.6, got %v", addrs)
+		}
+	}
+	// A /31 has no network or broadcast address.
+	seen := map[netip.Addr]bool{}
+	for i := 0; i < 100; i++ {
+		addrs, _ := expandNetworkPrefix("10.1.0.4/31", 1, DefaultMaxTargets)
+		seen[addrs[0]] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected both addresses of the /31 sampled, got %v", seen)
+	}
+	// Prefixes without more usable addresses than the sample are expanded.
+	addrs, err = expandNetworkPrefix("10.1.0.0/24", 254, DefaultMaxTargets)
+	if err != nil || len(addrs) != 256 {
+		t.Errorf("Expected 256 addresses, got %d, error %v", len(addrs), err)
+	}
+}
+
+func TestParseTargetIpsMax(t *testing.T) {
+	// Rejected without expanding the prefix.
+	_, err := parseTargetIps([]string{"10.0.0.0/8"}, 0, DefaultMaxTargets)
+	if err == nil || !strings.Contains(err.Error(), "10.0.0.0/8 expands to more than 4096 targets") {
+		t.Errorf("Expected /8 to be rejected, got %v", err)
+	}
+	_, err = parseTargetIps([]string{"10.1.0.0/16"}, 0, DefaultMaxTargets)
+	if err == nil {
+		t.Errorf("Expected /16 to be rejected")
+	}
+	// The limit is on all targets.
+	_, err = parseTargetIps([]string{"10.0.0.1", "10.1.0.0/20"}, 0, DefaultMaxTargets)
+	if err == nil || !strings.Contains(err.Error(), "10.1.0.0/20 expands to more than 4095 targets") {
+		t.Errorf("Expected the /20 to exceed the remaining targets, got %v", err)
+	}
+
+	addrs, err := parseTargetIps([]string{"10.1.0.0/16"}, 0, 1<<16)
+	if err != nil || len(addrs) != 1<<16 {
+		t.Errorf("Expected %d targets, got %d, error %v", 1<<16, len(addrs), err)
+	}
+	addrs, err = parseTargetIps([]string{"10.1.0.0/16"}, 100, DefaultMaxTargets)
+	if err != nil || len(addrs) != 100 {
+		t.Errorf("Expected 100 sampled targets, got %d, error %v", len(addrs), err)
+	}
+}
+
+func TestExpandNetworkPrefix(t *testing.T) {
+	v6 := []string{}
+	for i := 0; i < 256; i++ {
+		v6 = append(v6, netip.MustParseAddr(fmt.Sprintf("fd00::%x", i)).String())
+	}
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"10.0.0.4/30", []string{"10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7"}},
+		{"10.0.0.6/30", []string{"10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7"}},
+		{"10.0.0.255/31", []string{"10.0.0.254", "10.0.0.255"}},
+		{"255.255.255.254/31", []string{"255.255.255.254", "255.255.255.255"}},
+		{"fd00::/120", v6},
+		{"fd00::1:ff/127", []string{"fd00::1:fe", "fd00::1:ff"}},
+	}
+	for _, tc := range tests {
+		addrs, err := expandNetworkPrefix(tc.prefix, 0, DefaultMaxTargets)
+		if err != nil {
+			t.Errorf("%s: Expected no error, got %v", tc.prefix, err)
+			continue
+		}
+		got := []string{}
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		if strings.Join(got, " ") != strings.Join(tc.expected, " ") {
+			t.Errorf("%s: Expected %v, got %v", tc.prefix, tc.expected, got)
+		}
+	}
+}
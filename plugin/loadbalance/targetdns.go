@@ -0,0 +1,122 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/upstream"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Resolve the target DNS name every 30s.
+const DefaultTargetDNSInterval = 30 * time.Second
+
+var errNoServer = errors.New("no query served yet")
+
+// setServer records the server of a query, for the upstream lookups of the
+// target DNS name. The first call triggers the first lookup.
+func (sm *SessionManager) setServer(ctx context.Context) {
+	if sm.targetDNS == "" || sm.server.Load() != nil {
+		return
+	}
+	server, ok := ctx.Value(dnsserver.Key{}).(*dnsserver.Server)
+	if !ok {
+		return
+	}
+	if sm.server.CompareAndSwap(nil, server) {
+		close(sm.serverKnown)
+	}
+}
+
+// resolveTargets resolves the target DNS name once a query revealed the
+// server, and then every targetDNSInterval, until the manager stops.
+func (sm *SessionManager) resolveTargets() {
+	select {
+	case <-sm.serverKnown:
+	case <-sm.ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(sm.targetDNSInterval)
+	defer ticker.Stop()
+	for {
+		sm.refreshTargets(sm.ctx)
+		select {
+		case <-ticker.C:
+		case <-sm.ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshTargets sets the targets to the static targets and the addresses
+// of the target DNS name. On failure, the last known targets are kept. An
+// empty answer counts as a failure, so a glitch doesn't drain the pool.
+func (sm *SessionManager) refreshTargets(ctx context.Context) {
+	addrs := []netip.Addr{}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg, err := sm.lookup(ctx, sm.targetDNS, qtype)
+		if err != nil {
+			log.Warningf("Failed to resolve %s: %v. Keeping the last known targets.", sm.targetDNS, err)
+			return
+		}
+		if msg.Rcode != dns.RcodeSuccess {
+			log.Warningf("Failed to resolve %s: %s. Keeping the last known targets.", sm.targetDNS, dns.RcodeToString[msg.Rcode])
+			return
+		}
+		for _, rr := range msg.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		log.Warningf("No addresses for %s. Keeping the last known targets.", sm.targetDNS)
+		return
+	}
+	sm.SetTargets(append(addrs, sm.staticTargets...))
+}
+
+// lookupUpstream looks up name via CoreDNS itself, with plugin.Upstream.
+func (sm *SessionManager) lookupUpstream(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	server := sm.server.Load()
+	if server == nil {
+		return nil, errNoServer
+	}
+	ctx = context.WithValue(ctx, dnsserver.Key{}, server)
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	state := request.Request{W: localWriter{}, Req: req}
+	msg, err := upstream.New().Lookup(ctx, state, dns.Fqdn(name), qtype)
+	if err == nil && msg == nil {
+		err = errors.New("no response")
+	}
+	return msg, err
+}
+
+// localWriter is the response writer of the upstream lookups, which come
+// from the local host. The lookups replace WriteMsg to capture the response.
+type localWriter struct{}
+
+func (localWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv6loopback, Port: 53} }
+func (localWriter) RemoteAddr() net.Addr        { return &net.UDPAddr{IP: net.IPv6loopback, Port: 0} }
+func (localWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (localWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (localWriter) Close() error                { return nil }
+func (localWriter) TsigStatus() error           { return nil }
+func (localWriter) TsigTimersOnly(bool)         {}
+func (localWriter) Hijack()                     {}
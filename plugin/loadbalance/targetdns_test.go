@@ -0,0 +1,111 @@
+package loadbalance
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	testutil "github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestRefreshTargets(t *testing.T) {
+	var mutex sync.Mutex
+	rcode, records := dns.RcodeSuccess, []string{"10.0.0.2", "10.0.0.3", "fd00::1"}
+	backend := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		for _, record := range records {
+			addr := netip.MustParseAddr(record)
+			if addr.Is4() && r.Question[0].Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, testutil.A("backend.example. 30 IN A "+record))
+			}
+			if addr.Is6() && r.Question[0].Qtype == dns.TypeAAAA {
+				m.Answer = append(m.Answer, testutil.AAAA("backend.example. 30 IN AAAA "+record))
+			}
+		}
+		w.WriteMsg(m)
+		return rcode, nil
+	})
+	session := newTestSession()
+	sm := session.manager
+	defer sm.Stop()
+	sm.targetDNS = "backend.example"
+	sm.staticTargets = []netip.Addr{netip.MustParseAddr("10.0.0.1")}
+	sm.SetTargets(sm.staticTargets)
+	config := &dnsserver.Config{Zone: ".", Plugin: []plugin.Plugin{
+		func(next plugin.Handler) plugin.Handler { return LoadBalance{Next: next, session: session} },
+		func(plugin.Handler) plugin.Handler { return backend },
+	}}
+	server, err := dnsserver.NewServer("dns://:0", []*dnsserver.Config{config})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	targets := func() []string {
+		sm.mutex.RLock()
+		defer sm.mutex.RUnlock()
+		ips := []string{}
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1"} {
+			if _, ok := sm.hosts[netip.MustParseAddr(ip)]; ok {
+				ips = append(ips, ip)
+			}
+		}
+		return ips
+	}
+	check := func(step string, want ...string) {
+		t.Helper()
+		if got := targets(); len(got) != len(want) || len(sm.hosts) != len(want) {
+			t.Errorf("%s: Expected targets %v, got %v", step, want, got)
+		} else {
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("%s: Expected targets %v, got %v", step, want, got)
+					break
+				}
+			}
+		}
+	}
+
+	// No query served yet, so the lookup fails.
+	sm.refreshTargets(context.Background())
+	check("before the first query", "10.0.0.1")
+
+	// A query reveals the server.
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	m := new(dns.Msg)
+	m.SetQuestion("other.example.", dns.TypeA)
+	LoadBalance{Next: backend, session: session}.ServeDNS(ctx, &testutil.ResponseWriter{}, m)
+	select {
+	case <-sm.serverKnown:
+	default:
+		t.Fatalf("Expected the server to be known after a query")
+	}
+	sm.refreshTargets(context.Background())
+	check("resolved", "10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1")
+
+	// Failures keep the last known targets.
+	mutex.Lock()
+	rcode = dns.RcodeServerFailure
+	mutex.Unlock()
+	sm.refreshTargets(context.Background())
+	check("servfail", "10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1")
+	mutex.Lock()
+	rcode, records = dns.RcodeSuccess, nil
+	mutex.Unlock()
+	sm.refreshTargets(context.Background())
+	check("empty", "10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1")
+
+	// Departed hosts are removed, the static targets kept.
+	mutex.Lock()
+	records = []string{"10.0.0.3"}
+	mutex.Unlock()
+	sm.refreshTargets(context.Background())
+	check("scaled down", "10.0.0.1", "10.0.0.3")
+}
@@ -0,0 +1,81 @@
+package loadbalance
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Maximum number of active set changes waiting to be sent to the webhook.
+const webhookQueueSize = 64
+
+// activeChange is the payload posted to the webhook when a host is added to
+// or removed from the active set.
+type activeChange struct {
+	Host   string    `json:"host"`
+	Active bool      `json:"active"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// webhook posts active set changes to a URL. Changes are queued and sent in
+// the background, so notify never blocks scraping.
+type webhook struct {
+	url     string
+	client  *http.Client
+	changes chan activeChange
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newWebhook(url string) *webhook {
+	w := &webhook{
+		url:     url,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		changes: make(chan activeChange, webhookQueueSize),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// notify queues the change, dropping it if the queue is full.
+func (w *webhook) notify(change activeChange) {
+	select {
+	case w.changes <- change:
+	default:
+		log.Warningf("Webhook queue full. Dropping change for host %s", change.Host)
+	}
+}
+
+// stop stops sending changes. Queued changes are dropped.
+func (w *webhook) stop() {
+	w.once.Do(func() { close(w.done) })
+}
+
+func (w *webhook) run() {
+	for {
+		var change activeChange
+		select {
+		case change = <-w.changes:
+		case <-w.done:
+			return
+		}
+		body, err := json.Marshal(change)
+		if err != nil {
+			log.Errorf("Failed to encode webhook payload: %v", err)
+			continue
+		}
+		resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Errorf("Failed to post to webhook %s: %v", w.url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Errorf("Webhook %s returned %s", w.url, resp.Status)
+		}
+	}
+}
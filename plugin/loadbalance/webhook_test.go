@@ -0,0 +1,55 @@
+package loadbalance
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookActiveChange(t *testing.T) {
+	changes := make(chan activeChange, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change activeChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			t.Errorf("Failed to decode webhook payload: %v", err)
+		}
+		changes <- change
+	}))
+	defer server.Close()
+
+	sm := NewSessionManager()
+	sm.webhook = newWebhook(server.URL)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	sm.now = func() time.Time { return now }
+	host := addActiveHost(sm, "10.0.0.1", 1)
+	delete(sm.active, host.ip)
+
+	// Added, unchanged, then removed.
+	sm.updateActive(host)
+	sm.updateActive(host)
+	host.healthy = false
+	sm.updateActive(host)
+
+	for _, expected := range []activeChange{
+		{Active: true, Reason: reasonScraped},
+		{Active: false, Reason: reasonUnhealthy},
+	} {
+		select {
+		case change := <-changes:
+			if change.Host != "10.0.0.1" || change.Active != expected.Active || change.Reason != expected.Reason ||
+				!change.Time.Equal(now) {
+				t.Errorf("Expected change for 10.0.0.1 to active %v (%s) at %v, got %+v",
+					expected.Active, expected.Reason, now, change)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for webhook")
+		}
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("Expected no more changes, got %+v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -3,6 +3,7 @@ package loadbalance
 import (
 	"context"
 	"errors"
+	"math/rand"
 	"net"
 	"strings"
 	"testing"
@@ -206,6 +207,40 @@ func TestPeriodicWeightUpdate(t *testing.T) {
 	}
 }
 
+func TestWeightFileReloadUnchanged(t *testing.T) {
+	testFile, rm, err := testutil.TempFile(".", twoDomainsWRR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm()
+	random := &randomUint{rn: rand.New(rand.NewSource(1))}
+	reference := rand.New(rand.NewSource(1))
+	weighted := &weightedRR{fileName: testFile, randomGen: random}
+	if err := weighted.updateWeights(); err != nil {
+		t.Fatal(err)
+	}
+	w1 := weighted.domains["w1.example.org."][0]
+	weighted.randUint(10)
+	reference.Intn(10)
+
+	// The md5 check skips the unchanged file, so the weights and the state
+	// of the selection carry over.
+	if err := weighted.updateWeights(); err != nil {
+		t.Fatal(err)
+	}
+	if weighted.domains["w1.example.org."][0] != w1 {
+		t.Errorf("Expected the weights kept when reloading an unchanged file")
+	}
+	if weighted.randomGen != random {
+		t.Errorf("Expected the random generator kept when reloading an unchanged file")
+	}
+	for i := 0; i < 10; i++ {
+		if got, want := weighted.randUint(10), uint(reference.Intn(10)); got != want {
+			t.Fatalf("Selection %d: Expected %d from the continued random state, got %d", i, want, got)
+		}
+	}
+}
+
 // Fake random number generator for testing
 type fakeRandomGen struct {
 	expectedLimit uint